@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Returns the path of activate.fish, the counterpart of the activate script
+// for fish
+func (c *Cachenv) FishActivateScriptPath() string {
+	return filepath.Join(c.Dir, "activate.fish")
+}
+
+// Returns the content of activate.fish
+func fishActivateScript() string {
+	return fmt.Sprintf(`
+# This script must be invoked from fish via 'source <cachenv>/activate.fish'.
+
+# Check if already activated. Activating a different cachenv on top would
+# leave deactivation restoring the wrong PATH, so refuse.
+if set -q CACHENV
+    if test (builtin realpath "$CACHENV" 2>/dev/null) = (builtin realpath (dirname (status --current-filename)))
+        echo "cachenv is already activated."
+        exit 0
+    end
+    echo "Another cachenv ($CACHENV) is already activated; run 'deactivate_cachenv' first." >&2
+    exit 1
+end
+
+# Function to deactivate cachenv and restore original environment
+function deactivate_cachenv
+    if not set -q CACHENV
+        echo "cachenv is not activated."
+        return
+    end
+
+    # Restore the original PATH
+    set -gx PATH $_CACHENV_OLD_PATH
+    set -e _CACHENV_OLD_PATH
+    set -e _CACHENV_EXECUTABLE
+    set -e CACHENV
+
+    # Restore old prompt
+    if functions -q _cachenv_old_fish_prompt
+        functions -e fish_prompt
+        functions -c _cachenv_old_fish_prompt fish_prompt
+        functions -e _cachenv_old_fish_prompt
+    end
+
+    # Remove shell functions
+    functions -e cachenv
+    functions -e deactivate_cachenv
+end
+
+# Intercept cachenv itself, mirroring the bash activate script. fish doesn't
+# cache command lookups, so unlike bash there's no need to rehash after 'add',
+# 'unadd', 'link' or 'doctor'.
+function cachenv
+    # Another way to run deactivate. When the output is captured, as by
+    # cachenv deactivate --fish | source, let cachenv print the code instead.
+    if test "$argv[1]" = deactivate; and isatty stdout
+        deactivate_cachenv
+        return
+    end
+
+    $_CACHENV_EXECUTABLE $argv
+end
+
+set -gx CACHENV (builtin realpath (dirname (status --current-filename)))
+set -g _CACHENV_OLD_PATH $PATH
+set -gx _CACHENV_EXECUTABLE "$CACHENV/%[1]s/cachenv"
+
+set -gx PATH "$CACHENV/%[2]s" $PATH
+
+# Add a prefix to the shell prompt
+if functions -q fish_prompt
+    functions -c fish_prompt _cachenv_old_fish_prompt
+    function fish_prompt
+        printf "(%%s) " (basename "$CACHENV")
+        _cachenv_old_fish_prompt
+    end
+end
+`, LINKS_TO_REAL_NAME, LINKS_IN_PATH_NAME)
+}
+
+// Creates activate.fish
+func (c *Cachenv) CreateFishActivateScript() error {
+	activateScriptPath := c.FishActivateScriptPath()
+	if err := writeFileAtomic(activateScriptPath, []byte(fishActivateScript()), 0644); err != nil {
+		return fmt.Errorf("failed to write fish activate script: %w", err)
+	}
+
+	infof("Created activate script at %s\n", activateScriptPath)
+	return nil
+}
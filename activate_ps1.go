@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Returns the path of activate.ps1, the counterpart of the activate script
+// for PowerShell (e.g. on Windows)
+func (c *Cachenv) PowerShellActivateScriptPath() string {
+	return filepath.Join(c.Dir, "activate.ps1")
+}
+
+// Returns the content of activate.ps1
+func powerShellActivateScript() string {
+	return fmt.Sprintf(`
+# This script must be dot-sourced from PowerShell via '. <cachenv>/activate.ps1'.
+
+# Check if already activated. Activating a different cachenv on top would
+# leave deactivation restoring the wrong PATH, so refuse.
+if ($env:CACHENV) {
+    if ((Resolve-Path $env:CACHENV -ErrorAction SilentlyContinue).Path -eq (Resolve-Path $PSScriptRoot).Path) {
+        Write-Host "cachenv is already activated."
+        return
+    }
+    Write-Error "Another cachenv ($env:CACHENV) is already activated; run 'deactivate_cachenv' first."
+    return
+}
+
+# Function to deactivate cachenv and restore original environment
+function global:deactivate_cachenv {
+    if (-not $env:CACHENV) {
+        Write-Host "cachenv is not activated."
+        return
+    }
+
+    # Restore the original PATH
+    $env:PATH = $global:_CACHENV_OLD_PATH
+    Remove-Variable -Scope Global _CACHENV_OLD_PATH
+    Remove-Variable -Scope Global _CACHENV_EXECUTABLE
+    Remove-Item Env:CACHENV
+
+    # Restore old prompt
+    if (Test-Path Function:_cachenv_old_prompt) {
+        Copy-Item Function:_cachenv_old_prompt Function:global:prompt -Force
+        Remove-Item Function:_cachenv_old_prompt
+    }
+
+    # Remove functions
+    Remove-Item Function:cachenv
+    Remove-Item Function:deactivate_cachenv
+}
+
+# Intercept cachenv itself, mirroring the bash activate script. PowerShell
+# doesn't cache command lookups, so there's no need to rehash after 'add'.
+function global:cachenv {
+    if ($args.Count -gt 0 -and $args[0] -eq "deactivate") {
+        deactivate_cachenv
+        return
+    }
+    & $global:_CACHENV_EXECUTABLE @args
+}
+
+$env:CACHENV = (Resolve-Path $PSScriptRoot).Path
+$global:_CACHENV_OLD_PATH = $env:PATH
+
+# The link to the cachenv executable is a symlink, or on Windows a file
+# holding its path
+$link = Join-Path (Join-Path $env:CACHENV "%[1]s") "cachenv"
+if ((Get-Item $link).LinkType) {
+    $global:_CACHENV_EXECUTABLE = $link
+} else {
+    $global:_CACHENV_EXECUTABLE = (Get-Content $link -TotalCount 1).Trim()
+}
+Remove-Variable link
+
+$env:PATH = (Join-Path $env:CACHENV "%[2]s") + [IO.Path]::PathSeparator + $env:PATH
+
+# Add a prefix to the prompt
+Copy-Item Function:prompt Function:global:_cachenv_old_prompt
+function global:prompt {
+    "(" + (Split-Path $env:CACHENV -Leaf) + ") " + (_cachenv_old_prompt)
+}
+`, LINKS_TO_REAL_NAME, LINKS_IN_PATH_NAME)
+}
+
+// Creates activate.ps1
+func (c *Cachenv) CreatePowerShellActivateScript() error {
+	activateScriptPath := c.PowerShellActivateScriptPath()
+	if err := writeFileAtomic(activateScriptPath, []byte(powerShellActivateScript()), 0644); err != nil {
+		return fmt.Errorf("failed to write PowerShell activate script: %w", err)
+	}
+
+	infof("Created activate script at %s\n", activateScriptPath)
+	return nil
+}
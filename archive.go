@@ -0,0 +1,261 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Export/import */
+
+// Directory within archives holding cache entries, one subdirectory per hash
+const ARCHIVE_DATA_DIR = "data"
+
+// Adds the file at path to the archive under name, streaming its contents
+func addFileToTar(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Writes a gzipped tarball of the config and every cache entry to w
+func (c *Cachenv) Export(w io.Writer) (int, error) {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	if err := addFileToTar(tw, c.ConfigPath, CONFIG_NAME); err != nil {
+		return 0, fmt.Errorf("failed to archive config: %w", err)
+	}
+
+	keys, err := c.FS.Keys()
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		files, err := os.ReadDir(c.FS.KeyDir(key))
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			// Locks are only meaningful to processes on this machine
+			if !file.Type().IsRegular() || file.Name() == store.LOCK_NAME {
+				continue
+			}
+			name := path.Join(ARCHIVE_DATA_DIR, key.Hash, file.Name())
+			if err := addFileToTar(tw, filepath.Join(c.FS.KeyDir(key), file.Name()), name); err != nil {
+				return 0, fmt.Errorf("failed to archive entry %s: %w", key.Hash, err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gw.Close(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// Bundles the config and cache into a tarball, to be loaded elsewhere with
+// 'cachenv import'
+func handleExport(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv export <file.tar.gz|->")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	var out io.Writer = os.Stdout
+	if args[0] != "-" {
+		f, err := os.Create(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	n, err := c.Export(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting cache: %v\n", err)
+		return 1
+	}
+	infof("Exported %d entries.\n", n)
+	return 0
+}
+
+// Files which may appear in an archived entry
+var archivedEntryFiles = map[string]bool{
+	"out": true, "out" + store.GZIP_EXT: true,
+	"err": true, "err" + store.GZIP_EXT: true,
+	"status": true,
+	"meta":   true,
+	"files":  true, "files" + store.GZIP_EXT: true,
+}
+
+// Reports why the staged entry in dir is malformed, or "" if it is complete
+func validateStagedEntry(dir string) string {
+	for _, name := range []string{"out", "err"} {
+		if _, err := os.Stat(store.ResolveOutputPath(filepath.Join(dir, name))); err != nil {
+			return fmt.Sprintf("missing '%s'", name)
+		}
+	}
+	status, err := os.ReadFile(filepath.Join(dir, "status"))
+	if err != nil {
+		return "missing 'status'"
+	}
+	if _, err := strconv.Atoi(string(status)); err != nil {
+		return fmt.Sprintf("invalid 'status' %q", status)
+	}
+	return ""
+}
+
+// Unpacks entries from a tarball produced by Export into the store. Existing
+// entries are kept unless overwrite is set; malformed entries are skipped with
+// a warning. Returns the number of entries imported and skipped.
+func (c *Cachenv) Import(r io.Reader, overwrite bool) (int, int, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gr.Close()
+
+	if err := os.MkdirAll(c.FS.Dir, c.FS.DirMode()); err != nil {
+		return 0, 0, err
+	}
+	stagingDir, err := os.MkdirTemp(c.FS.Dir, store.STAGING_PREFIX)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	// Stage every entry's files, then move complete entries into place
+	var hashes []string
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		parts := strings.Split(path.Clean(header.Name), "/")
+		if len(parts) != 3 || parts[0] != ARCHIVE_DATA_DIR || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		hash, name := parts[1], parts[2]
+		if !store.IsHex(hash) || !archivedEntryFiles[name] {
+			fmt.Fprintf(os.Stderr, "Warning: skipping unexpected archive member '%s'\n", header.Name)
+			continue
+		}
+
+		entryDir := filepath.Join(stagingDir, hash)
+		if _, err := os.Stat(entryDir); os.IsNotExist(err) {
+			if err := os.Mkdir(entryDir, c.FS.DirMode()); err != nil {
+				return 0, 0, err
+			}
+			hashes = append(hashes, hash)
+		}
+		f, err := os.OpenFile(filepath.Join(entryDir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, c.FS.FileMode())
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to extract '%s': %w", header.Name, err)
+		}
+	}
+
+	imported, skipped := 0, 0
+	for _, hash := range hashes {
+		key := store.CacheKey{Hash: hash}
+		entryDir := filepath.Join(stagingDir, hash)
+		if problem := validateStagedEntry(entryDir); problem != "" {
+			fmt.Fprintf(os.Stderr, "Warning: skipping malformed entry %s: %s\n", hash, problem)
+			skipped++
+			continue
+		}
+		// Under the entry's lock, replacing any existing entry atomically,
+		// and counted toward max_entries like a written entry
+		adopted, err := c.FS.Adopt(key, entryDir, overwrite)
+		if err != nil {
+			return imported, skipped, fmt.Errorf("failed to import entry %s: %w", hash, err)
+		}
+		if !adopted {
+			skipped++
+			continue
+		}
+		imported++
+	}
+	return imported, skipped, nil
+}
+
+// Loads entries from a tarball produced by 'cachenv export'
+func handleImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	overwrite := flags.Bool("overwrite", false, "replace existing entries")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv import [--overwrite] <file.tar.gz|->")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	imported, skipped, err := c.Import(in, *overwrite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing cache: %v\n", err)
+		return 1
+	}
+	infof("Imported %d entries, skipped %d.\n", imported, skipped)
+	return 0
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+func TestImport(t *testing.T) {
+	src := newTestCachenv(t, nil)
+	seedEntry(t, src, "aaaa", "ls", 100)
+	seedEntry(t, src, "bbbb", "curl", 200)
+	var archive bytes.Buffer
+	if _, err := src.Export(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// Imported entries count toward max_entries
+	dst := newTestCachenv(t, nil)
+	dst.FS.MaxEntries = 1
+	imported, skipped, err := dst.Import(bytes.NewReader(archive.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 || skipped != 0 {
+		t.Errorf("imported %d and skipped %d, want 2 and 0", imported, skipped)
+	}
+	kept := 0
+	for _, hash := range []string{"aaaa", "bbbb"} {
+		if dst.FS.Exists(store.CacheKey{Hash: hash}) {
+			kept++
+		}
+	}
+	if kept != 1 {
+		t.Errorf("%d entries kept after import, want max_entries (1)", kept)
+	}
+
+	// Existing entries are kept, or replaced with --overwrite
+	dst = newTestCachenv(t, nil)
+	seedEntry(t, dst, "aaaa", "ls", 50)
+	out := filepath.Join(dst.FS.KeyDir(store.CacheKey{Hash: "aaaa"}), "out")
+	before, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, skipped, err = dst.Import(bytes.NewReader(archive.Bytes()), false); err != nil {
+		t.Fatal(err)
+	} else if skipped != 1 {
+		t.Errorf("skipped %d existing entries, want 1", skipped)
+	}
+	if after, err := os.ReadFile(out); err != nil || !bytes.Equal(after, before) {
+		t.Error("existing entry replaced without --overwrite")
+	}
+	if imported, _, err = dst.Import(bytes.NewReader(archive.Bytes()), true); err != nil {
+		t.Fatal(err)
+	} else if imported != 2 {
+		t.Errorf("imported %d entries with --overwrite, want 2", imported)
+	}
+	if after, err := os.ReadFile(out); err != nil || bytes.Equal(after, before) {
+		t.Errorf("existing entry not replaced with --overwrite: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/* Argument normalization */
+
+// A flag listed in config, e.g. "--color" or "--output FILE". A placeholder
+// after the flag means its value may follow as a separate argument.
+type argPattern struct {
+	flag       string
+	takesValue bool
+}
+
+func parseArgPattern(pattern string) argPattern {
+	fields := strings.Fields(pattern)
+	if len(fields) == 0 {
+		return argPattern{}
+	}
+	return argPattern{flag: fields[0], takesValue: len(fields) > 1}
+}
+
+// Returns args without those matching any of patterns. Both "--flag=value"
+// and, for patterns with a placeholder, "--flag value" forms are removed.
+// Arguments after "--" are never removed.
+func stripArgs(args []string, patterns []string) []string {
+	if len(patterns) == 0 {
+		return args
+	}
+	parsed := make([]argPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		if p := parseArgPattern(pattern); p.flag != "" {
+			parsed = append(parsed, p)
+		}
+	}
+
+	stripped := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			stripped = append(stripped, args[i:]...)
+			break
+		}
+		matched := false
+		for _, p := range parsed {
+			if arg == p.flag {
+				matched = true
+				if p.takesValue && i+1 < len(args) {
+					i++
+				}
+				break
+			}
+			if strings.HasPrefix(arg, p.flag+"=") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			stripped = append(stripped, arg)
+		}
+	}
+	return stripped
+}
+
+// Reports whether any of args matches one of patterns, as in stripArgs
+func hasAnyArg(args []string, patterns []string) bool {
+	return len(stripArgs(args, patterns)) != len(args)
+}
+
+// Returns the patterns whose flag also appears in others, e.g. the
+// bypass_if_args which are also ignore_args
+func sharedFlags(patterns []string, others []string) []string {
+	flags := make(map[string]bool, len(others))
+	for _, other := range others {
+		flags[parseArgPattern(other).flag] = true
+	}
+	var shared []string
+	for _, pattern := range patterns {
+		if p := parseArgPattern(pattern); p.flag != "" && flags[p.flag] {
+			shared = append(shared, pattern)
+		}
+	}
+	return shared
+}
+
+// Returns args without those matching any of the volatile patterns: arguments
+// which vary between invocations without affecting the output. A pattern
+// starting with "-" is a flag, removed along with its value ("--flag value"
+// or "--flag=value"). Any other pattern is a glob (as in path.Match) removing
+// matching positional arguments, e.g. "/tmp/tmp.*".
+func stripVolatileArgs(args []string, patterns []string) []string {
+	var flags, globs []string
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "-") {
+			flags = append(flags, parseArgPattern(pattern).flag+" VALUE")
+		} else {
+			globs = append(globs, pattern)
+		}
+	}
+	args = stripArgs(args, flags)
+	if len(globs) == 0 {
+		return args
+	}
+
+	stripped := make([]string, 0, len(args))
+	positional := false
+	for _, arg := range args {
+		if !positional && arg == "--" {
+			positional = true
+			stripped = append(stripped, arg)
+			continue
+		}
+		if (positional || !strings.HasPrefix(arg, "-")) && matchesAnyGlob(globs, arg) {
+			continue
+		}
+		stripped = append(stripped, arg)
+	}
+	return stripped
+}
+
+func matchesAnyGlob(globs []string, s string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns only the args matching patterns, for commands whose output depends
+// on a few known arguments. A pattern is either a flag, as in stripArgs, or
+// "$N" for the Nth positional argument (counting from 1). Matched flags are
+// normalized to "--flag=value" (or just "--flag"), so that both forms yield
+// the same key.
+//
+// Arguments not starting with "-" count as positional, except values of the
+// flags in patterns, as do all arguments after "--".
+func selectArgs(args []string, patterns []string) []string {
+	var flags []argPattern
+	positions := make(map[int]bool)
+	for _, pattern := range patterns {
+		if n, ok := parsePosition(pattern); ok {
+			positions[n] = true
+		} else if p := parseArgPattern(pattern); p.flag != "" {
+			flags = append(flags, p)
+		}
+	}
+
+	var selected []string
+	position := 0
+	afterDashes := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !afterDashes && arg == "--" {
+			afterDashes = true
+			continue
+		}
+		if afterDashes || !strings.HasPrefix(arg, "-") {
+			position++
+			if positions[position] {
+				selected = append(selected, fmt.Sprintf("$%d=%s", position, arg))
+			}
+			continue
+		}
+		for _, p := range flags {
+			if arg == p.flag {
+				if p.takesValue && i+1 < len(args) {
+					i++
+					arg += "=" + args[i]
+				}
+				selected = append(selected, arg)
+				break
+			}
+			if strings.HasPrefix(arg, p.flag+"=") {
+				selected = append(selected, arg)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// Parses a "$N" positional pattern
+func parsePosition(pattern string) (int, bool) {
+	if !strings.HasPrefix(pattern, "$") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(pattern[1:])
+	return n, err == nil && n > 0
+}
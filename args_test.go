@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+func TestStripArgs(t *testing.T) {
+	patterns := []string{"--color", "-v", "--format FMT"}
+	for _, test := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"--color", "-l"}, []string{"-l"}},
+		{[]string{"--color=auto", "-l"}, []string{"-l"}},
+		{[]string{"-v", "a"}, []string{"a"}},
+		{[]string{"--format", "json", "a"}, []string{"a"}},
+		{[]string{"--format=json", "a"}, []string{"a"}},
+		{[]string{"--colorful", "a"}, []string{"--colorful", "a"}},
+		{[]string{"a", "--", "--color"}, []string{"a", "--", "--color"}},
+	} {
+		if actual := stripArgs(test.args, patterns); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("stripArgs(%q) = %q, want %q", test.args, actual, test.expected)
+		}
+	}
+}
+
+func TestIgnoredArgsShareKey(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{
+		"ls": {IgnoreArgs: []string{"--color", "--format FMT"}},
+	})
+
+	base, err := c.KeyFor("ls", []string{"/tmp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"--color=auto", "/tmp"},
+		{"--color", "/tmp"},
+		{"--format", "long", "/tmp"},
+		{"--format=long", "/tmp"},
+	} {
+		key, err := c.KeyFor("ls", args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Hash != base.Hash {
+			t.Errorf("ls %q has a different key from ls /tmp", args)
+		}
+	}
+
+	other, err := c.KeyFor("ls", []string{"-l", "/tmp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Hash == base.Hash {
+		t.Error("an argument not in ignore_args was left out of the key")
+	}
+}
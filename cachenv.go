@@ -2,11 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aromatt/cachenv/store"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,49 +30,166 @@ const (
 	LINKS_TO_REAL_NAME = "links-to-real"
 )
 
-type ExecResult struct {
-	Stdout   []byte
-	Stderr   []byte
-	ExitCode int
-}
+// Number of commands whose symlinks RefreshLinksForAll refreshes at once
+const LINK_WORKERS = 16
 
 type Cachenv struct {
 	ConfigPath string
 	Dir        string
-	Config     Config
-	Store      *Store
+	Config     store.Config
+
+	// Where entries are read from and written to, and bookkeeping (locks,
+	// stats, etc.) is kept. Memoized commands use nothing else.
+	Store store.Store
+
+	// The local store, which subcommands managing entries (e.g. list, prune)
+	// work on. Unless another backend is plugged in, Store is FS; remote
+	// backends keep their bookkeeping in it.
+	FS *store.FSStore
 }
 
 func NewCachenv(configPath, dir string) *Cachenv {
+	fs := &store.FSStore{
+		Dir: filepath.Join(dir, "data"),
+	}
 	return &Cachenv{
 		ConfigPath: configPath,
 		Dir:        dir,
-		Store: &Store{
-			Dir: filepath.Join(dir, "data"),
-		},
+		Store:      fs,
+		FS:         fs,
 	}
 }
 
 func (c *Cachenv) LoadConfig() error {
-	configFile, err := os.Open(c.ConfigPath)
+	data, err := os.ReadFile(c.ConfigPath)
 	if err != nil {
 		return fmt.Errorf("failed to open config file: %w", err)
 	}
-	defer configFile.Close()
+	if c.Config, err = decodeConfig(data); err != nil {
+		return err
+	}
+	if err := c.Config.Validate(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	c.Config = c.Config.Resolved()
+	for cmd := range c.Config.Commands {
+		if _, err := c.RedactorFor(cmd); err != nil {
+			return err
+		}
+	}
+
+	c.FS.Compress = c.Config.Cache.Compress
+	c.FS.Private = c.Config.Cache.Private
+	c.FS.MaxEntries = c.Config.Cache.MaxEntries
+	switch remote := c.Config.Cache.Remote; {
+	case remote.Bucket != "":
+		c.Store = store.NewS3Store(remote, c.FS)
+	case remote.URL != "":
+		c.Store = store.NewHTTPStore(remote, c.FS)
+	}
+
+	return nil
+}
+
+// Decodes a config file, rejecting unknown keys (e.g. misspellings)
+func decodeConfig(data []byte) (store.Config, error) {
+	var config store.Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("failed to decode config: %w", err)
+	}
+	if config.Commands == nil {
+		config.Commands = make(map[string]store.CommandConfig)
+	}
+	return config, nil
+}
+
+// Applies update to the latest config, writing it back if update reports a
+// change. The cachenv directory is locked meanwhile, so that concurrent
+// updates (e.g. two 'cachenv add's) don't lose each other's changes.
+func (c *Cachenv) UpdateConfig(update func(config *store.Config) bool) error {
+	unlock, err := store.LockDir(c.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to lock cachenv directory: %w", err)
+	}
+	defer unlock()
 
-	decoder := yaml.NewDecoder(configFile)
-	if err := decoder.Decode(&c.Config); err != nil {
-		return fmt.Errorf("failed to decode config: %w", err)
+	data, err := os.ReadFile(c.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	config, err := decodeConfig(data)
+	if err != nil {
+		return err
+	}
+	if !update(&config) {
+		return nil
+	}
+	if err := c.writeConfig(config); err != nil {
+		return err
 	}
+	c.Config = config.Resolved()
+	return nil
+}
 
+// Writes config to the config file, atomically so that an interrupted write
+// can't leave it truncated
+func (c *Cachenv) writeConfig(config store.Config) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := writeFileAtomic(c.ConfigPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
 	return nil
 }
 
+// Replaces the file at path with data by writing a temporary file beside it
+// and renaming it into place, so that readers see either the old or the new
+// contents, never a partial write. If path is a symlink, its target is
+// replaced.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Reports whether command is memoized, or is an alias of a memoized command
 func (c *Cachenv) IsCommandMemoized(command string) bool {
-	_, ok := c.Config.Commands[command]
+	_, ok := c.Config.Commands[c.Config.Canonical(command)]
 	return ok
 }
 
+// Returns the names which are intercepted: the memoized commands and their
+// aliases
+func (c *Cachenv) InterceptedNames() []string {
+	names := make([]string, 0, len(c.Config.Commands)+len(c.Config.Aliases))
+	for cmd := range c.Config.Commands {
+		names = append(names, cmd)
+	}
+	for alias := range c.Config.Aliases {
+		names = append(names, alias)
+	}
+	return names
+}
+
 // Directory containing symlinks cmd -> cachenv executable
 func (c *Cachenv) DirLinksInPath() string {
 	return filepath.Join(c.Dir, LINKS_IN_PATH_NAME)
@@ -84,6 +215,12 @@ func (c *Cachenv) LinkToReal(cmd string) string {
 	return filepath.Join(c.DirLinksToReal(), cmd)
 }
 
+// Returns the path to execute to run the real cmd: its link, wherever the
+// platform allows executing links directly
+func (c *Cachenv) RealExecutable(cmd string) string {
+	return linkExecutable(c.LinkToReal(cmd))
+}
+
 // Path to the real cachenv executable
 func (c *Cachenv) LinkToRealCachenv() string {
 	return filepath.Join(c.DirLinksToReal(), "cachenv")
@@ -109,7 +246,7 @@ func (c *Cachenv) CreateCachenvLink() error {
 	}
 
 	// Create new symlink
-	if err := os.Symlink(cachenvExecPath, c.LinkToRealCachenv()); err != nil {
+	if err := makeLink(cachenvExecPath, c.LinkToRealCachenv()); err != nil {
 		return fmt.Errorf("failed to create symlink to real cachenv: %w", err)
 	}
 	return nil
@@ -117,16 +254,14 @@ func (c *Cachenv) CreateCachenvLink() error {
 
 // Removes the symlink created by CreateCachenvLink().
 func (c *Cachenv) RemoveCachenvLink() error {
-	if _, err := os.Lstat(c.LinkToRealCachenv()); err == nil {
-		if err := os.Remove(c.LinkToRealCachenv()); err != nil {
-			return fmt.Errorf("failed to remove existing symlink to real cachenv: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		return fmt.Errorf("failed to stat symlink to real cachenv: %w", err)
+	if err := removeLink(c.LinkToRealCachenv()); err != nil {
+		return fmt.Errorf("failed to remove existing symlink to real cachenv: %w", err)
 	}
 	return nil
 }
 
+// Creates the cachenv, or regenerates the activate scripts and the link to
+// the cachenv executable of an existing one. An existing config is kept.
 func (c *Cachenv) Init() error {
 	if err := c.InitializeEnv(); err != nil {
 		return err
@@ -140,10 +275,21 @@ func (c *Cachenv) Init() error {
 		return err
 	}
 
+	if err := c.CreateFishActivateScript(); err != nil {
+		return err
+	}
+
+	if err := c.CreatePowerShellActivateScript(); err != nil {
+		return err
+	}
+
 	if err := c.CreateLinksDirs(); err != nil {
 		return err
 	}
 
+	if err := c.RemoveCachenvLink(); err != nil {
+		return err
+	}
 	if err := c.CreateCachenvLink(); err != nil {
 		return err
 	}
@@ -151,52 +297,202 @@ func (c *Cachenv) Init() error {
 	return nil
 }
 
+// Describes what Init would change in an existing cachenv, e.g. overwriting
+// a customized activate script. Returns nothing if it's up to date.
+func (c *Cachenv) InitChanges() ([]string, error) {
+	var changes []string
+	for _, script := range []struct{ path, content string }{
+		{c.ActivateScriptPath(), activateScript()},
+		{c.FishActivateScriptPath(), fishActivateScript()},
+		{c.PowerShellActivateScriptPath(), powerShellActivateScript()},
+	} {
+		data, err := os.ReadFile(script.path)
+		switch {
+		case os.IsNotExist(err):
+			changes = append(changes, fmt.Sprintf("create %s", script.path))
+		case err != nil:
+			return nil, err
+		case string(data) != script.content:
+			changes = append(changes, fmt.Sprintf("overwrite %s, which differs from the generated script", script.path))
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cachenv executable path: %w", err)
+	}
+	if target, err := readLink(c.LinkToRealCachenv()); err != nil || target != self {
+		changes = append(changes, fmt.Sprintf("link %s to %s", c.LinkToRealCachenv(), self))
+	}
+	return changes, nil
+}
+
+// Adds the commands and aliases configured in from to the config, returning
+// the number added. Names which the config already has, configured
+// differently, are kept as they are and reported as conflicts.
+func (c *Cachenv) MergeConfig(from store.Config) (int, []string, error) {
+	var added int
+	var conflicts []string
+	var invalid error
+	err := c.UpdateConfig(func(config *store.Config) bool {
+		merged := *config
+		merged.Commands = make(map[string]store.CommandConfig, len(config.Commands))
+		for cmd, cmdConfig := range config.Commands {
+			merged.Commands[cmd] = cmdConfig
+		}
+		merged.Aliases = make(map[string]string, len(config.Aliases))
+		for alias, cmd := range config.Aliases {
+			merged.Aliases[alias] = cmd
+		}
+
+		// Imported commands keep the options they had from the defaults
+		// of the config they came from
+		for cmd, cmdConfig := range from.Resolved().Commands {
+			if existing, ok := config.Commands[cmd]; ok {
+				if !existing.Equal(cmdConfig) {
+					conflicts = append(conflicts, fmt.Sprintf("command '%s' is already configured differently", cmd))
+				}
+			} else if target, ok := config.Aliases[cmd]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("'%s' is already an alias of '%s'", cmd, target))
+			} else {
+				merged.Commands[cmd] = cmdConfig
+				added++
+			}
+		}
+		for alias, target := range from.Aliases {
+			if existing, ok := config.Aliases[alias]; ok {
+				if existing != target {
+					conflicts = append(conflicts, fmt.Sprintf("'%s' is already an alias of '%s'", alias, existing))
+				}
+			} else if _, ok := config.Commands[alias]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("'%s' is already a memoized command", alias))
+			} else {
+				merged.Aliases[alias] = target
+				added++
+			}
+		}
+		if len(merged.Aliases) == 0 {
+			merged.Aliases = nil
+		}
+		sort.Strings(conflicts)
+
+		if invalid = merged.Validate(); invalid != nil || added == 0 {
+			return false
+		}
+		*config = merged
+		return true
+	})
+	if err == nil {
+		err = invalid
+	}
+	return added, conflicts, err
+}
+
+// Creates the symlinks which intercept cmd, replacing any which are outdated.
+// Links which are already correct are left alone.
 func (c *Cachenv) RefreshLinksFor(cmd string) error {
 	linkInPath := c.LinkInPath(cmd)
 	linkToReal := c.LinkToReal(cmd)
 
+	// Find the real cmd (as configured, or in PATH). An alias links to the
+	// real command it's an alias for. Our own links in PATH, which may be
+	// found first, are skipped, to avoid recursive cachenv invocations.
+	canonical := c.Config.Canonical(cmd)
+	realPath := c.Config.Commands[canonical].Path
+	var resolveErr error
+	if realPath != "" {
+		resolveErr = checkExecutable(realPath)
+	} else if path, ok := lookPathSkippingSelf(canonical); ok {
+		realPath = path
+	} else {
+		resolveErr = fmt.Errorf("failed to find real path for %s: not found in PATH", canonical)
+	}
+
+	if resolveErr == nil {
+		inPathTarget, _ := readLink(linkInPath)
+		toRealTarget, _ := readLink(linkToReal)
+		if inPathTarget == c.LinkToRealRelative("cachenv") && toRealTarget == realPath {
+			return nil
+		}
+	}
+
 	// Remove existing symlinks for cmd if they exist.
 	for _, link := range []string{linkInPath, linkToReal} {
-		if _, err := os.Lstat(link); err == nil {
-			if err := os.Remove(link); err != nil {
-				return fmt.Errorf("failed to remove existing symlink for %s: %w", cmd, err)
-			}
-		} else if !os.IsNotExist(err) {
-			return fmt.Errorf("failed to stat symlink for %s: %w", cmd, err)
+		if err := removeLink(link); err != nil {
+			return fmt.Errorf("failed to remove existing symlink for %s: %w", cmd, err)
 		}
 	}
+	if resolveErr != nil {
+		return resolveErr
+	}
 
 	// Order matters here!
 
-	// 1. Create symlink cmd -> real cmd (via exec.LookPath), to avoid recursive
-	// cachenv invocations
-	if realPath, err := exec.LookPath(cmd); err == nil {
-		if err := os.Symlink(realPath, linkToReal); err != nil {
-			return fmt.Errorf("failed to create symlink for %s: %w", cmd, err)
-		}
-	} else {
-		return fmt.Errorf("failed to find real path for %s: %w", cmd, err)
+	// 1. Create symlink cmd -> real cmd
+	if err := makeLink(realPath, linkToReal); err != nil {
+		return fmt.Errorf("failed to create symlink for %s: %w", cmd, err)
 	}
 
 	// 2. Create symlink <cmd in $PATH> -> cachenv, so we can intercept
 	// invocations
 	// Note: we use a relative link target to make envs more easily portable
-	if err := os.Symlink(c.LinkToRealRelative("cachenv"), linkInPath); err != nil {
+	if err := makeLink(c.LinkToRealRelative("cachenv"), linkInPath); err != nil {
 		return fmt.Errorf("failed to create symlink for %s: %w", cmd, err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Refreshed symlink for %s\n", cmd)
+	infof("Refreshed symlink for %s\n", cmd)
+	return nil
+}
+
+// Returns an error unless path is an executable file
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("'%s' does not exist", path)
+	}
+	if !isExecutable(path, info) {
+		return fmt.Errorf("'%s' is not an executable file", path)
+	}
+	return nil
+}
+
+// Removes the symlinks which intercept cmd
+func (c *Cachenv) RemoveLinksFor(cmd string) error {
+	for _, link := range []string{c.LinkInPath(cmd), c.LinkToReal(cmd)} {
+		if err := removeLink(link); err != nil {
+			return fmt.Errorf("failed to remove symlink for %s: %w", cmd, err)
+		}
+	}
+	infof("Removed symlink for %s\n", cmd)
 	return nil
 }
 
 func (c *Cachenv) RefreshLinksForAll() error {
 	var err error
 
-	// Create symlinks for all commands in the config
-	for cmd := range c.Config.Commands {
-		if err = c.RefreshLinksFor(cmd); err != nil {
-			return err
-		}
+	// Create symlinks for all commands and aliases in the config. Each
+	// command's links are independent, so several are refreshed at once.
+	names := make(chan string)
+	errs := make([]error, LINK_WORKERS)
+	var wg sync.WaitGroup
+	for i := 0; i < LINK_WORKERS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for cmd := range names {
+				if err := c.RefreshLinksFor(cmd); err != nil {
+					errs[i] = errors.Join(errs[i], err)
+				}
+			}
+		}(i)
+	}
+	for _, cmd := range c.InterceptedNames() {
+		names <- cmd
+	}
+	close(names)
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
 	}
 
 	// Delete any symlinks that are not in the config
@@ -206,41 +502,63 @@ func (c *Cachenv) RefreshLinksForAll() error {
 	}
 
 	for _, entry := range entries {
-		if _, ok := c.Config.Commands[entry.Name()]; !ok {
+		name := linkName(entry.Name())
+		if !c.IsCommandMemoized(name) {
 			// Skip the cachenv symlink (it would otherwise be removed because
 			// it's not in the config)
-			if entry.Name() == "cachenv" {
+			if name == "cachenv" {
 				continue
 			}
-			symlinkPath := filepath.Join(c.DirLinksInPath(), entry.Name())
-			if err := os.Remove(symlinkPath); err != nil {
-				return fmt.Errorf("failed to remove symlink for %s: %w", entry.Name(), err)
+			if err := removeLink(filepath.Join(c.DirLinksInPath(), name)); err != nil {
+				return fmt.Errorf("failed to remove symlink for %s: %w", name, err)
 			}
-			fmt.Fprintf(os.Stderr, "Removed symlink for %s\n", entry.Name())
+			infof("Removed symlink for %s\n", name)
 		}
 	}
 
 	return nil
 }
 
-func (c *Cachenv) CreateActivateScript() error {
-	// Define the path to the activate script within the bin directory
-	activateScriptPath := filepath.Join(c.Dir, "activate")
+// Returns the path of the activate script, for bash and zsh
+func (c *Cachenv) ActivateScriptPath() string {
+	return filepath.Join(c.Dir, "activate")
+}
 
-	// Define the content of the activate script
-	activateScriptContent := fmt.Sprintf(`
+// Returns the content of the activate script
+func activateScript() string {
+	return fmt.Sprintf(`
 # This script must be invoked from your shell via 'source <cachenv>/activate'.
-# This script is heavily inspired by virtualenv's activate script.
-
-if [ "${BASH_SOURCE[0]}" = "$0" ]; then
+# It supports bash and zsh, and is heavily inspired by virtualenv's activate
+# script.
+
+# Find the path of this script, which zsh and bash expose differently
+if [ -n "${ZSH_VERSION-}" ]; then
+    case "$ZSH_EVAL_CONTEXT" in
+        *:file*) ;;
+        *)
+            echo "You must source this script: \$ source $0" >&2
+            exit 33
+            ;;
+    esac
+    _CACHENV_SCRIPT="${(%%):-%%x}"
+elif [ "${BASH_SOURCE[0]}" = "$0" ]; then
     echo "You must source this script: \$ source $0" >&2
     exit 33
+else
+    _CACHENV_SCRIPT="${BASH_SOURCE[0]}"
 fi
 
-# Check if already activated
+# Check if already activated. Activating a different cachenv on top would
+# leave deactivation restoring the wrong PATH, so refuse.
 if ! [ -z "$CACHENV" ]; then
-    echo "cachenv is already activated."
-    return 0
+    if [ "$(cd "$CACHENV" 2>/dev/null && pwd -P)" = "$(cd "$(dirname "$_CACHENV_SCRIPT")" && pwd -P)" ]; then
+        echo "cachenv is already activated."
+        unset _CACHENV_SCRIPT
+        return 0
+    fi
+    echo "Another cachenv ($CACHENV) is already activated; run 'deactivate_cachenv' first." >&2
+    unset _CACHENV_SCRIPT
+    return 1
 fi
 
 # Function to deactivate cachenv and restore original environment
@@ -256,9 +574,17 @@ deactivate_cachenv() {
     unset _CACHENV_EXECUTABLE
     unset CACHENV
 
+    # Remove the path-qualified invocation check. In bash, signal the DEBUG
+    # trap to remove itself, since it can't be reset from inside a function.
+    unset _CACHENV_DEBUG_TRAP
+    if [ -n "${ZSH_VERSION-}" ]; then
+        add-zsh-hook -d preexec _cachenv_check_bypass
+    fi
+
     # Remove shell functions
     unset -f deactivate_cachenv
     unset -f cachenv
+    unset -f _cachenv_check_bypass
 
     # Needed for some commands after changing PATH
     hash -r 2>/dev/null
@@ -273,8 +599,9 @@ deactivate_cachenv() {
 
 # Intercept cachenv itself so that we can run 'hash -r' after adding new symlinks
 cachenv() {
-    # Another way to run deactivate
-    if [ "$1" = "deactivate" ]; then
+    # Another way to run deactivate. When the output is captured, as by
+    # eval "$(cachenv deactivate)", let cachenv print the code to run instead.
+    if [ "$1" = "deactivate" ] && [ -t 1 ]; then
         deactivate_cachenv
         return
     fi
@@ -282,7 +609,7 @@ cachenv() {
     "$_CACHENV_EXECUTABLE" "$@"
     local cachenv_exit_code=$?
 
-    if [ "$1" = "add" ] || [ "$1" = "link" ]; then
+    if [ "$1" = "add" ] || [ "$1" = "unadd" ] || [ "$1" = "link" ] || [ "$1" = "doctor" ]; then
         # Needed for some commands after changing PATH
         hash -r 2>/dev/null
     fi
@@ -290,11 +617,36 @@ cachenv() {
     return $cachenv_exit_code
 }
 
-export CACHENV="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
-export _CACHENV_OLD_PATH="$PATH"
-export _CACHENV_EXECUTABLE="${CACHENV}/%s/cachenv"
+# Warn when a memoized command is invoked with a path (e.g. ./ls), which
+# bypasses the symlinks in PATH and therefore the cache. Takes the command
+# line about to be executed.
+_cachenv_check_bypass() {
+    local cmd="${1%%%% *}"
+    case "$cmd" in
+        */*)
+            if [ -L "$CACHENV/%[2]s/${cmd##*/}" ]; then
+                echo "cachenv: '$cmd' bypasses the cache; use 'cachenv run $cmd' instead" >&2
+            fi
+            ;;
+    esac
+}
 
-export PATH="$CACHENV/%s:$PATH"
+export CACHENV="$(cd "$(dirname "$_CACHENV_SCRIPT")" && pwd)"
+unset _CACHENV_SCRIPT
+export _CACHENV_OLD_PATH="$PATH"
+export _CACHENV_EXECUTABLE="${CACHENV}/%[1]s/cachenv"
+
+export PATH="$CACHENV/%[2]s:$PATH"
+
+# Check each command line before it runs: via a preexec hook in zsh, or a
+# DEBUG trap in bash (unless that would clobber one installed by the user)
+if [ -n "${ZSH_VERSION-}" ]; then
+    autoload -Uz add-zsh-hook
+    add-zsh-hook preexec _cachenv_check_bypass
+elif [ -z "$(trap -p DEBUG)" ]; then
+    _CACHENV_DEBUG_TRAP=1
+    trap 'if [ -n "${_CACHENV_DEBUG_TRAP-}" ]; then _cachenv_check_bypass "$BASH_COMMAND"; else trap - DEBUG; fi' DEBUG
+fi
 
 # Needed for some commands after changing PATH
 hash -r 2>/dev/null
@@ -308,20 +660,24 @@ else
 fi
 export PS1
 `, LINKS_TO_REAL_NAME, LINKS_IN_PATH_NAME)
+}
+
+func (c *Cachenv) CreateActivateScript() error {
+	activateScriptPath := c.ActivateScriptPath()
 
 	// Ensure the bin directory exists
 	if err := os.MkdirAll(c.DirLinksInPath(), 0755); err != nil {
 		return fmt.Errorf("failed to create bin directory: %w", err)
 	}
 
-	// Write the activate script content to the file
-	// TODO: do this atomically
-	err := os.WriteFile(activateScriptPath, []byte(activateScriptContent), 0755)
+	// Write the activate script content to the file. A partial script could
+	// break the shell sourcing it, so replace it atomically.
+	err := writeFileAtomic(activateScriptPath, []byte(activateScript()), 0755)
 	if err != nil {
 		return fmt.Errorf("failed to write activate script: %w", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "Created activate script at %s\n", activateScriptPath)
+	infof("Created activate script at %s\n", activateScriptPath)
 	return nil
 }
 
@@ -336,85 +692,571 @@ func (c *Cachenv) InitializeEnv() error {
 
 	// Create the config file if it does not exist
 	if _, err := os.Stat(c.ConfigPath); os.IsNotExist(err) {
-		defaultConfig := Config{
-			Commands: make(map[string]CommandConfig, 0),
-			Cache: CacheConfig{
+		defaultConfig := store.Config{
+			Commands: make(map[string]store.CommandConfig, 0),
+			Cache: store.CacheConfig{
 				MaxEntries: 1000, // TODO make configurable
 			},
 		}
-		configFile, err := os.Create(c.ConfigPath)
-		if err != nil {
+		if err := c.writeConfig(defaultConfig); err != nil {
 			return fmt.Errorf("failed to create config file: %w", err)
 		}
-		defer configFile.Close()
+	}
 
-		encoder := yaml.NewEncoder(configFile)
-		if err := encoder.Encode(defaultConfig); err != nil {
-			return fmt.Errorf("failed to encode default config: %w", err)
-		}
+	return nil
+}
+
+// Reports whether the executable at path is the same file that the memoized
+// cmd links to
+func (c *Cachenv) IsRealCommand(path, cmd string) bool {
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
 	}
+	realInfo, err := os.Stat(c.RealExecutable(cmd))
+	if err != nil {
+		return false
+	}
+	return os.SameFile(pathInfo, realInfo)
+}
 
+// Returns an error if cmdName's link to the real command leads back to
+// cachenv (e.g. in a corrupted env), which would otherwise invoke itself
+// endlessly
+func (c *Cachenv) checkNotSelf(cmdName string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return nil
+	}
+	selfInfo, err := os.Stat(self)
+	if err != nil {
+		return nil
+	}
+	realPath := c.RealExecutable(cmdName)
+	if realInfo, err := os.Stat(realPath); err == nil && (os.SameFile(realInfo, selfInfo) || isShim(realPath)) {
+		return fmt.Errorf("the link to the real '%s' leads back to cachenv; run 'cachenv doctor --fix' to repair it", cmdName)
+	}
 	return nil
 }
 
-func (c *Cachenv) PrepareRealCommand(cmdName string, args ...string) *exec.Cmd {
-	return exec.Command(filepath.Join(c.DirLinksToReal(), cmdName), args...)
+func (c *Cachenv) PrepareRealCommand(ctx context.Context, cmdName string, args ...string) (*exec.Cmd, error) {
+	if err := c.checkNotSelf(cmdName); err != nil {
+		return nil, err
+	}
+	return exec.CommandContext(ctx, c.RealExecutable(cmdName), args...), nil
+}
+
+type ExecOptions struct {
+	// If non-nil, fed to the command's standard input. Otherwise the
+	// command reads ours.
+	Stdin []byte
+
+	// If non-nil, the command's output is streamed to these as it runs, in
+	// addition to being captured
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// If positive, capture stops once stdout and stderr together exceed this
+	// many bytes. Streaming to Stdout and Stderr continues regardless.
+	MaxCapture int64
+
+	// If positive, the command (and any processes it started) is killed
+	// after running this long
+	Timeout time.Duration
+
+	// If non-nil, output is redacted line by line before it's streamed or
+	// captured
+	Redactor *Redactor
+
+	// Variables ("KEY=value") added to the command's environment
+	Env []string
+}
+
+// Exit code reported for commands killed for exceeding their timeout, as with
+// timeout(1)
+const TIMEOUT_EXIT_CODE = 124
+
+// Exit codes reported by intercepted commands when cachenv itself fails, as
+// with env(1), so that they aren't mistaken for the command's own failures.
+// Every other exit code is the command's.
+const (
+	// cachenv failed, e.g. to load its config or read stdin
+	INTERNAL_ERROR_EXIT_CODE = 125
+	// The command was found but couldn't be run
+	CANNOT_EXECUTE_EXIT_CODE = 126
+	// The command wasn't found
+	NOT_FOUND_EXIT_CODE = 127
+)
+
+// Returns the exit code to report when err kept the command from running
+func execErrorExitCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return NOT_FOUND_EXIT_CODE
+	}
+	return CANNOT_EXECUTE_EXIT_CODE
+}
+
+// Returns the exit code of a command which has exited, reporting a command
+// killed by a signal as a shell does (128+N) rather than as -1
+func exitCodeOf(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
 }
 
-func (c *Cachenv) ExecuteRealCommand(cmdName string, args ...string) (ExecResult, error) {
+// Runs the real command, capturing its output
+func (c *Cachenv) ExecuteRealCommand(opts ExecOptions, cmdName string, args ...string) (store.ExecResult, error) {
 	var exitCode int
 	var stdoutBuf, stderrBuf bytes.Buffer
 
-	cmd := c.PrepareRealCommand(cmdName, args...)
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	cmd, err := c.PrepareRealCommand(ctx, cmdName, args...)
+	if err != nil {
+		return store.ExecResult{}, err
+	}
+	// A command with a timeout runs in its own process group, so that the
+	// timeout kills any processes it starts too. Others stay in ours, which
+	// may be the terminal's foreground group, so that e.g. password prompts
+	// can read the terminal and Ctrl-Z reaches them.
+	if opts.Timeout > 0 {
+		setProcessGroup(cmd)
+	}
+
+	cmd.Stdin = os.Stdin
+	if opts.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(opts.Stdin)
+	}
+	if len(opts.Env) > 0 {
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
+	limit := &captureLimit{remaining: opts.MaxCapture}
+	var stdoutCapture, stderrCapture io.Writer = &stdoutBuf, &stderrBuf
+	if opts.MaxCapture > 0 {
+		stdoutCapture = &limitedWriter{&stdoutBuf, limit}
+		stderrCapture = &limitedWriter{&stderrBuf, limit}
+	}
+	cmd.Stdout = stdoutCapture
+	if opts.Stdout != nil {
+		cmd.Stdout = io.MultiWriter(opts.Stdout, stdoutCapture)
+	}
+	cmd.Stderr = stderrCapture
+	if opts.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(opts.Stderr, stderrCapture)
+	}
+	var redactors []*redactingWriter
+	if opts.Redactor != nil {
+		redactors = []*redactingWriter{
+			{w: cmd.Stdout, redactor: opts.Redactor},
+			{w: cmd.Stderr, redactor: opts.Redactor},
+		}
+		cmd.Stdout, cmd.Stderr = redactors[0], redactors[1]
+	}
+
+	// Relay signals meant for us (e.g. Ctrl-C) to the command, noting that
+	// its output is incomplete. Default handling is restored once it exits.
+	// The handler goes in first, so that a signal arriving as the command
+	// starts is relayed once it has, rather than killing us and orphaning it.
+	var interrupt atomic.Int32
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		signal.Stop(signals)
+		return store.ExecResult{}, err
+	}
 
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				interrupt.Store(int32(sig.(syscall.Signal)))
+				signalProcessGroup(cmd, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	duration := time.Since(started)
+	signal.Stop(signals)
+	close(done)
+	for _, rw := range redactors {
+		rw.Flush()
+	}
 
-	err := cmd.Run()
+	if sig := interrupt.Load(); sig != 0 {
+		// As a shell reports a process killed by a signal
+		return store.ExecResult{ExitCode: 128 + int(sig), Interrupted: true}, nil
+	}
+	// The timeout kills the command with a signal, so check for it first
+	if ctx.Err() == context.DeadlineExceeded {
+		return store.ExecResult{ExitCode: TIMEOUT_EXIT_CODE, TimedOut: true}, nil
+	}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return store.ExecResult{ExitCode: exitCodeOf(cmd.ProcessState), Signaled: true}, nil
+	}
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			exitCode = exitError.ExitCode()
 		} else {
-			return ExecResult{}, fmt.Errorf("Error executing command: %v\n", err)
+			return store.ExecResult{}, err
 		}
 	} else {
 		exitCode = cmd.ProcessState.ExitCode()
 	}
 
-	return ExecResult{
+	if limit.exceeded {
+		return store.ExecResult{ExitCode: exitCode, Truncated: true}, nil
+	}
+	return store.ExecResult{
 		Stdout:   stdoutBuf.Bytes(),
 		Stderr:   stderrBuf.Bytes(),
 		ExitCode: exitCode,
+		Duration: duration,
 	}, nil
 }
 
+// Byte budget shared by the writers capturing a command's stdout and stderr
+type captureLimit struct {
+	mu        sync.Mutex
+	remaining int64
+	exceeded  bool
+}
+
+// Captures into buf until the shared limit is exceeded, then discards
+// everything. Never fails, so that writers it's combined with (e.g. by
+// io.MultiWriter) keep receiving output.
+type limitedWriter struct {
+	buf   *bytes.Buffer
+	limit *captureLimit
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.limit.mu.Lock()
+	defer w.limit.mu.Unlock()
+	if w.limit.exceeded {
+		return len(p), nil
+	}
+	if int64(len(p)) > w.limit.remaining {
+		w.limit.exceeded = true
+		w.buf.Reset()
+		return len(p), nil
+	}
+	w.limit.remaining -= int64(len(p))
+	return w.buf.Write(p)
+}
+
+// Returns the arguments cmd actually runs with: its default_args if it's
+// invoked without any
+func (c *Cachenv) ArgsFor(cmd string, args []string) []string {
+	if len(args) == 0 {
+		return c.Config.Commands[cmd].DefaultArgs
+	}
+	return args
+}
+
+// Computes the key for an invocation of a memoized command, applying the
+// command's configuration
+func (c *Cachenv) KeyFor(cmd string, args []string, stdin []byte) (store.CacheKey, error) {
+	cmd = c.Config.Canonical(cmd)
+	cmdConfig := c.Config.Commands[cmd]
+	args = c.ArgsFor(cmd, args)
+	inputs := store.KeyInputs{Stdin: stdin}
+	if cmdConfig.CwdSensitive {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return store.CacheKey{}, fmt.Errorf("failed to get working directory: %w", err)
+		}
+		inputs.Cwd = cwd
+	}
+	if len(cmdConfig.WatchFiles) > 0 || cmdConfig.WatchArgs {
+		files, err := watchedFiles(cmdConfig, args)
+		if err != nil {
+			return store.CacheKey{}, err
+		}
+		inputs.Files = files
+	}
+	if cmdConfig.KeyBinary != "" {
+		fingerprint, err := c.binaryFingerprint(cmd, cmdConfig.KeyBinary)
+		if err != nil {
+			return store.CacheKey{}, err
+		}
+		inputs.Binary = fingerprint
+	}
+	// Invocations which bypass the cache share the key of those which don't,
+	// so that the entry they refresh is the one those read
+	args = stripArgs(args, cmdConfig.BypassIfArgs)
+	keyArgs := stripVolatileArgs(stripArgs(args, cmdConfig.IgnoreArgs), cmdConfig.VolatileArgs)
+	if cmdConfig.KeyArgs != nil {
+		keyArgs = selectArgs(args, cmdConfig.KeyArgs)
+	}
+	return c.Config.Hash.KeyFromInputs(cmd, keyArgs, inputs), nil
+}
+
+// Identifies the executable which the memoized cmd runs, resolving symlinks
+// (e.g. from a package manager's bin directory) to the actual file
+func (c *Cachenv) binaryFingerprint(cmd string, kind store.BinaryFingerprint) (string, error) {
+	path, err := filepath.EvalSymlinks(c.RealExecutable(cmd))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve executable for '%s': %w", cmd, err)
+	}
+	if kind == store.BINARY_FINGERPRINT_CONTENT {
+		return fileFingerprint(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat executable for '%s': %w", cmd, err)
+	}
+	return fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// Set for commands with force_color. Commands usually only color output
+// written to a terminal, which ours never is.
+var FORCE_COLOR_ENV = []string{"CLICOLOR_FORCE=1", "FORCE_COLOR=1"}
+
+// Returns the variables to add to the environment of the real cmd
+func (c *Cachenv) EnvFor(cmd string) []string {
+	if c.Config.Commands[cmd].ForceColor {
+		return FORCE_COLOR_ENV
+	}
+	return nil
+}
+
+// Reports whether an entry for key exists and hasn't expired. Entries whose
+// exit code the config wouldn't now cache (e.g. failures written before
+// failure_ttl was unset) are never fresh. Entries whose exit code can't be
+// read locally are judged by the longest TTL.
+func (c *Cachenv) Fresh(key store.CacheKey, cmdConfig store.CommandConfig) bool {
+	if !store.Fresh(c.Store, key, cmdConfig.MaxTTL()) {
+		return false
+	}
+	if exitCode, err := c.Store.ReadExitCode(key); err == nil {
+		return cmdConfig.Caches(exitCode) && store.Fresh(c.Store, key, cmdConfig.TTLFor(exitCode))
+	}
+	return true
+}
+
+// Returns the contents of stdin if it is piped or redirected from a file, or
+// nil if it is a terminal or empty.
+func readPipedStdin() ([]byte, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat stdin: %w", err)
+	}
+	if info.Mode()&os.ModeCharDevice != 0 {
+		return nil, nil
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stdin: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// Returns the stdin to include in the key of an invocation of cmd: its
+// contents (see readPipedStdin) if cmd is configured with stdin, otherwise
+// nil, leaving stdin unread
+func (c *Cachenv) StdinFor(cmd string) ([]byte, error) {
+	if !c.Config.Commands[c.Config.Canonical(cmd)].Stdin {
+		return nil, nil
+	}
+	return readPipedStdin()
+}
+
 func (c *Cachenv) HandleMemoizedCommand(cmd string, args []string) int {
-	key := KeyFrom(cmd, args)
-	var result ExecResult
-	var err error
+	cmd = c.Config.Canonical(cmd)
+
+	// Replace ourselves with the real command, leaving it the terminal to
+	// itself
+	if c.Config.Commands[cmd].SkipIfTTY && term.IsTerminal(int(os.Stdout.Fd())) {
+		argv := append([]string{cmd}, args...)
+		err := c.checkNotSelf(cmd)
+		if err == nil {
+			err = execReplacing(c.RealExecutable(cmd), argv)
+		}
+		fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
+		return execErrorExitCode(err)
+	}
 
-	if c.Store.Exists(key) {
+	stdin, err := c.StdinFor(cmd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return INTERNAL_ERROR_EXIT_CODE
+	}
+
+	args = c.ArgsFor(cmd, args)
+	key, err := c.KeyFor(cmd, args, stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
+		return INTERNAL_ERROR_EXIT_CODE
+	}
+	cmdConfig := c.Config.Commands[cmd]
+	var result store.ExecResult
+
+	// One of bypass_if_args skips the cache, only replacing the entry with
+	// bypass_refreshes. Those which are also ignore_args are only for us.
+	bypass := hasAnyArg(args, cmdConfig.BypassIfArgs)
+	if bypass {
+		args = stripArgs(args, sharedFlags(cmdConfig.BypassIfArgs, cmdConfig.IgnoreArgs))
+	}
+	readOnly := bypass && !cmdConfig.BypassRefreshes
+
+	// CACHENV_REFRESH forces a miss, replacing any existing entry. Entries
+	// written since we started (i.e. by an identical invocation we waited on
+	// below) still count as hits.
+	refresh := envFlag("CACHENV_REFRESH") || bypass
+	started := time.Now()
+	isHit := func() bool {
+		if readOnly || !c.Fresh(key, cmdConfig) {
+			return false
+		}
+		if !refresh {
+			return true
+		}
+		age, err := c.Store.Age(key)
+		return err == nil && age < time.Since(started)
+	}
+
+	// Hold the entry's lock while checking and populating it, so identical
+	// invocations run the real command only once. Like caching itself, this
+	// is best-effort: an unwritable cache still runs the command.
+	if !isHit() && !readOnly && c.Config.Cache.SingleFlightEnabled() {
+		if unlock, err := c.Store.Lock(key); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to lock cache entry: %v\n", err)
+		} else {
+			defer unlock()
+		}
+	}
+
+	hit := isHit()
+	if hit {
 		result, err = c.Store.ReadFromCache(key)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to read from cache: %v\n", err)
-			return 1
+			// E.g. a -1 status written by a version which cached signaled
+			// commands, or an unreachable remote cache. Run the command
+			// instead, replacing the entry.
+			fmt.Fprintf(os.Stderr, "Ignoring unreadable cache entry: %v\n", err)
+			hit = false
+		} else if !cmdConfig.Caches(result.ExitCode) || !store.Fresh(c.Store, key, cmdConfig.TTLFor(result.ExitCode)) {
+			// An uncacheable or expired failure, which Fresh couldn't tell
+			// without its exit code (e.g. from a remote cache)
+			hit = false
+		}
+	}
+
+	// Restore output files before the output, which may mention them. An
+	// entry written before output_files were configured has none, and so is
+	// replaced.
+	outputFiles := outputFilePaths(cmdConfig, args)
+	if hit && len(outputFiles) > 0 {
+		if result.Files == nil {
+			hit = false
+		} else if err := restoreOutputFiles(result.Files, outputFiles); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring cache entry: %v\n", err)
+			hit = false
+		}
+	}
+
+	if hit {
+		if err := c.Store.MarkUsed(key); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update cache index: %v\n", err)
+		}
+		if err := c.Store.RecordHit(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update stats: %v\n", err)
+		}
+
+		// Take as long as the command did, for reproducing timing-sensitive
+		// behavior
+		if cmdConfig.ReplayDelay {
+			if meta, err := c.Store.ReadMeta(key); err == nil {
+				time.Sleep(meta.Duration - time.Since(started))
+			}
 		}
+
+		fmt.Fprint(os.Stdout, string(result.Stdout))
+		fmt.Fprint(os.Stderr, string(result.Stderr))
 	} else {
-		result, err = c.ExecuteRealCommand(cmd, args...)
+		// Stream output as the command runs, so long-running commands don't
+		// appear to hang
+		maxOutputBytes := c.Config.MaxOutputBytesFor(cmd)
+		redactor, err := c.RedactorFor(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+			return INTERNAL_ERROR_EXIT_CODE
+		}
+		result, err = c.ExecuteRealCommand(ExecOptions{
+			Stdin:      stdin,
+			Stdout:     os.Stdout,
+			Stderr:     os.Stderr,
+			MaxCapture: maxOutputBytes,
+			Timeout:    cmdConfig.Timeout,
+			Redactor:   redactor,
+			Env:        c.EnvFor(cmd),
+		}, cmd, args...)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
-			return 1
+			return execErrorExitCode(err)
+		}
+		if err := c.Store.RecordMiss(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update stats: %v\n", err)
+		}
+
+		switch {
+		case result.Interrupted:
+			// The output is partial, and the user knows why
+		case result.Signaled:
+			fmt.Fprintf(os.Stderr, "Command '%s' was killed by a signal; not caching.\n", cmd)
+		case result.TimedOut:
+			fmt.Fprintf(os.Stderr, "Command '%s' timed out after %s; not caching.\n", cmd, cmdConfig.Timeout)
+		case result.Truncated:
+			fmt.Fprintf(os.Stderr, "Warning: output exceeded max_output_bytes (%d); not caching.\n", maxOutputBytes)
+		case readOnly:
+			// Bypassing the cache entirely
+		case cmdConfig.Caches(result.ExitCode):
+			if len(outputFiles) > 0 {
+				if result.Files, err = captureOutputFiles(outputFiles); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v; not caching.\n", err)
+					break
+				}
+			}
+			// Caching is best-effort: the output has already been shown, and
+			// the command's exit code is still the one to return
+			if err := c.Store.WriteToCache(key, result); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write to cache: %v\n", err)
+			}
 		}
+	}
 
-		err = c.Store.WriteToCache(key, result)
+	if c.Config.LogFile != "" {
+		err := c.Store.LogInvocation(c.Config.LogFile, c.Config.LogMaxBytes, store.Invocation{
+			Time:     started,
+			Command:  cmd,
+			Hash:     key.Hash,
+			Hit:      hit,
+			ExitCode: result.ExitCode,
+			Duration: time.Since(started).Seconds(),
+		})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to write to cache: %v\n", err)
-			return 1
+			fmt.Fprintf(os.Stderr, "Failed to write log: %v\n", err)
+		}
+	}
+	if c.Config.Metrics != "" {
+		if err := c.Store.WriteMetrics(c.Config.Metrics, c.Dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write metrics: %v\n", err)
 		}
 	}
 
-	fmt.Fprint(os.Stdout, string(result.Stdout))
-	fmt.Fprint(os.Stderr, string(result.Stderr))
 	return result.ExitCode
 }
 
@@ -422,21 +1264,58 @@ func main() {
 	// This program is used both for controlling cachenv (e.g. `cachenv init`)
 	// and for intercepting memoized commands. Use $0 to determine which is
 	// happening.
-	invokedCmd := filepath.Base(os.Args[0])
+	store.Version = buildVersion()
+	invokedCmd := invokedName()
 	exitCode := 0
 	switch invokedCmd {
 	case "cachenv":
-		if len(os.Args) < 2 {
-			fmt.Fprintln(os.Stderr, "Usage: cachenv <command> [arguments]")
+		usage := "Usage: cachenv [--quiet] [--dir DIR] [--config FILE] <command> [arguments]"
+		args, ok := parseGlobalFlags(os.Args[1:])
+		if !ok {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, usage)
 			return
 		}
-		exitCode = handleCachenvSubcommand(os.Args[1], os.Args[2:])
+		exitCode = handleCachenvSubcommand(args[0], args[1:])
 	default:
 		exitCode = handleMemoizedCommand(invokedCmd, os.Args[1:])
 	}
 	os.Exit(exitCode)
 }
 
+// Consumes the flags which precede the subcommand, returning the rest of args
+func parseGlobalFlags(args []string) ([]string, bool) {
+	for len(args) > 0 {
+		switch arg := args[0]; {
+		case arg == "--quiet" || arg == "-q":
+			quiet = true
+		case arg == "--dir":
+			if len(args) < 2 {
+				return nil, false
+			}
+			dirFlag = args[1]
+			args = args[1:]
+		case strings.HasPrefix(arg, "--dir="):
+			dirFlag = strings.TrimPrefix(arg, "--dir=")
+		case arg == "--config":
+			if len(args) < 2 {
+				return nil, false
+			}
+			configFlag = args[1]
+			args = args[1:]
+		case strings.HasPrefix(arg, "--config="):
+			configFlag = strings.TrimPrefix(arg, "--config=")
+		default:
+			return args, true
+		}
+		args = args[1:]
+	}
+	return args, true
+}
+
 func handleCachenvSubcommand(subcommand string, args []string) int {
 	switch subcommand {
 	case "init":
@@ -445,14 +1324,70 @@ func handleCachenvSubcommand(subcommand string, args []string) int {
 		return handleLink(args)
 	case "add":
 		return handleAdd(args)
+	case "unadd":
+		return handleUnadd(args)
 	case "key":
 		return handleKey(args)
 	case "touch":
 		return handleTouch(args)
 	case "diff":
 		return handleDiff(args)
+	case "size", "du":
+		return handleSize(args)
+	case "run":
+		return handleRun(args)
+	case "prune":
+		return handlePrune(args)
+	case "list":
+		return handleList(args)
+	case "clear":
+		return handleClear(args)
+	case "stats":
+		return handleStats(args)
+	case "export":
+		return handleExport(args)
+	case "import":
+		return handleImport(args)
+	case "info":
+		return handleInfo(args)
+	case "rm":
+		return handleRm(args)
+	case "gc":
+		return handleGC(args)
+	case "cat":
+		return handleCat(args)
+	case "migrate":
+		return handleMigrate(args)
+	case "which":
+		return handleWhich(args)
+	case "doctor":
+		return handleDoctor(args)
+	case "deactivate":
+		return handleDeactivate(args)
+	case "status":
+		return handleStatus(args)
+	case "replay":
+		return handleReplay(args)
+	case "validate":
+		return handleValidate(args)
+	case "verify":
+		return handleVerify(args)
+	case "warm":
+		return handleWarm(args)
+	case "chmod":
+		return handleChmod(args)
+	case "compare":
+		return handleCompare(args)
+	case "grep":
+		return handleGrep(args)
+	case "resolve":
+		return handleResolve(args)
+	case "keys":
+		return handleKeys(args)
+	case "version", "--version":
+		return handleVersion(args)
 	default:
-		fmt.Fprintln(os.Stderr, "Invalid command. Available commands are: init, link, add, key, touch, diff.")
+		fmt.Fprintln(os.Stderr, "Invalid command. Available commands are: init, link, add, unadd, key, touch, diff, size, run, prune, list, clear, stats, export, import, info, rm, gc, cat, migrate, du, which, doctor, deactivate, status, replay, validate, version, warm, verify, chmod, compare, grep, resolve, keys.")
 		return 1
 	}
 }
@@ -462,23 +1397,169 @@ func handleMemoizedCommand(cmd string, args []string) int {
 	c, err := loadActiveCachenv()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		// Most likely a stale symlink left in $PATH; don't break the command
+		if path, ok := lookPathSkippingSelf(cmd); ok {
+			fmt.Fprintf(os.Stderr, "Running '%s' uncached.\n", path)
+			return runDirect(path, args)
+		}
+		return INTERNAL_ERROR_EXIT_CODE
 	}
 	return c.HandleMemoizedCommand(cmd, args)
 }
 
-func handleInit(args []string) int {
+// Like exec.LookPath, but skips any match which is this executable (i.e. a
+// cachenv symlink), so that the real command is found
+func lookPathSkippingSelf(cmd string) (string, bool) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", false
+	}
+	selfInfo, err := os.Stat(self)
+	if err != nil {
+		return "", false
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		path, err := exec.LookPath(filepath.Join(dir, cmd))
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && !os.SameFile(info, selfInfo) && !isShim(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Runs a command through the cache as though it had been found via $PATH.
+// This covers path-qualified invocations like ./tool or /usr/bin/tool, which
+// the shell executes directly, bypassing the symlinks in $PATH.
+func handleRun(args []string) int {
 	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: cachenv init <DIR>")
+		fmt.Fprintln(os.Stderr, "Usage: cachenv run <command> [arguments]")
 		return 1
 	}
-	dir := args[0]
 
-	cachenv := loadCachenvFromDir(dir)
-	if err := cachenv.Init(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error initializing cachenv: %v\n", err)
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return INTERNAL_ERROR_EXIT_CODE
+	}
+
+	path := args[0]
+	cmdName := filepath.Base(path)
+	if !c.IsCommandMemoized(cmdName) {
+		return runDirect(path, args[1:])
+	}
+
+	// Don't attribute another program's output to the memoized command
+	if strings.ContainsRune(path, filepath.Separator) && !c.IsRealCommand(path, cmdName) {
+		fmt.Fprintf(os.Stderr, "Warning: '%s' is not the memoized '%s'; running it uncached.\n", path, cmdName)
+		return runDirect(path, args[1:])
+	}
+
+	return c.HandleMemoizedCommand(cmdName, args[1:])
+}
+
+// Runs a command with the standard streams attached, bypassing the cache
+func runDirect(path string, args []string) int {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return exitCodeOf(exitError.ProcessState)
+		}
+		fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
+		return execErrorExitCode(err)
+	}
+	return 0
+}
+
+// Creates a cachenv in DIR. Re-running it on an existing cachenv changes
+// nothing unless --force, which regenerates the activate scripts. --from adds
+// the commands configured in another config file (e.g. one committed to a
+// repo), and links them.
+func handleInit(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	force := flags.Bool("force", false, "regenerate the activate scripts of an existing cachenv")
+	fromPath := flags.String("from", "", "add the commands and aliases configured in this config file")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv init [--force] [--from CONFIG] <DIR>")
 		return 1
 	}
+	dir := flags.Arg(0)
+
+	// Read it first, so a bad file doesn't leave a half-initialized cachenv
+	var from store.Config
+	if *fromPath != "" {
+		data, err := os.ReadFile(*fromPath)
+		if err == nil {
+			from, err = decodeConfig(data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", *fromPath, err)
+			return 1
+		}
+	}
+
+	cachenv := loadCachenvFromDir(dir)
+	initialize := true
+	if _, err := os.Stat(cachenv.ConfigPath); err == nil {
+		changes, err := cachenv.InitChanges()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking existing cachenv: %v\n", err)
+			return 1
+		}
+		if len(changes) > 0 && !*force {
+			fmt.Fprintf(os.Stderr, "cachenv already exists at %s. 'cachenv init --force' would:\n", dir)
+			for _, change := range changes {
+				fmt.Fprintf(os.Stderr, "  %s\n", change)
+			}
+			return 1
+		}
+		if len(changes) == 0 {
+			if *fromPath == "" {
+				infof("cachenv at %s is already initialized.\n", dir)
+				return 0
+			}
+			initialize = false
+		}
+	}
+
+	if initialize {
+		if err := cachenv.Init(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing cachenv: %v\n", err)
+			return 1
+		}
+	}
+	if *fromPath == "" {
+		return 0
+	}
 
+	added, conflicts, err := cachenv.MergeConfig(from)
+	for _, conflict := range conflicts {
+		fmt.Fprintf(os.Stderr, "Not imported: %s.\n", conflict)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing %s: %v\n", *fromPath, err)
+		return 1
+	}
+	infof("Imported %d commands and aliases from %s.\n", added, *fromPath)
+	if err := cachenv.LoadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	if err := cachenv.RefreshLinksForAll(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error refreshing symlinks: %v\n", err)
+		return 1
+	}
+	if len(conflicts) > 0 {
+		return 1
+	}
 	return 0
 }
 
@@ -491,27 +1572,39 @@ func handleLink(args []string) int {
 		return 1
 	}
 
+	if len(args) == 0 && dirFlag != "" {
+		args = []string{dirFlag}
+	}
+
 	var c *Cachenv
 	var err error
-	if !isCachenvActivated() {
+	if !isCachenvActivated() || dirFlag != "" {
 		if len(args) != 1 {
 			fmt.Fprintln(os.Stderr, "Usage: cachenv link DIR")
 			return 1
 		}
+		// Links are rebuilt from the config, so a config which can't be read
+		// would remove them all
 		c = loadCachenvFromDir(args[0])
-		c.LoadConfig()
-
-		// Refresh symlink to cachenv executable. Note: this can't be done while
-		// activated.
-		if err = c.RemoveCachenvLink(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error removing symlink to cachenv: %v\n", err)
+		if err := c.LoadConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
 			return 1
 		}
-		if err = c.CreateCachenvLink(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating symlink to cachenv: %v\n", err)
-			return 1
+
+		// Refresh symlink to cachenv executable, unless it's current. Note:
+		// this can't be done while activated.
+		self, _ := os.Executable()
+		if target, err := readLink(c.LinkToRealCachenv()); err != nil || target != self {
+			if err = c.RemoveCachenvLink(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing symlink to cachenv: %v\n", err)
+				return 1
+			}
+			if err = c.CreateCachenvLink(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating symlink to cachenv: %v\n", err)
+				return 1
+			}
+			infof("Refreshed symlink for cachenv\n")
 		}
-		fmt.Fprintln(os.Stderr, "Refreshed symlink for cachenv")
 	} else {
 		c, err = loadActiveCachenv()
 		if err != nil {
@@ -528,9 +1621,39 @@ func handleLink(args []string) int {
 	return 0
 }
 
+// Commands built into bash or zsh. The shell runs these itself rather than
+// looking them up in PATH, so our symlinks never intercept them.
+var SHELL_BUILTINS = map[string]bool{
+	".": true, ":": true, "[": true, "alias": true, "bg": true, "bind": true,
+	"break": true, "builtin": true, "caller": true, "cd": true, "command": true,
+	"compgen": true, "complete": true, "continue": true, "declare": true,
+	"dirs": true, "disown": true, "echo": true, "enable": true, "eval": true,
+	"exec": true, "exit": true, "export": true, "false": true, "fc": true,
+	"fg": true, "getopts": true, "hash": true, "help": true, "history": true,
+	"jobs": true, "kill": true, "let": true, "local": true, "logout": true,
+	"mapfile": true, "popd": true, "printf": true, "pushd": true, "pwd": true,
+	"read": true, "readarray": true, "readonly": true, "return": true,
+	"set": true, "shift": true, "shopt": true, "source": true, "suspend": true,
+	"test": true, "times": true, "trap": true, "true": true, "type": true,
+	"typeset": true, "ulimit": true, "umask": true, "unalias": true,
+	"unset": true, "wait": true,
+}
+
+// Memoizes each of the given commands. Commands already memoized are skipped.
+// Exits 0 if at least one command was added.
 func handleAdd(args []string) int {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: cachenv add <command>")
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	force := flags.Bool("force", false, "add shell builtins, which only scripts running them via exec or env reach")
+	defaultArgs := flags.String("default-args", "", "whitespace-separated arguments to use when the command is invoked without any")
+	alias := flags.String("alias", "", "add this name as an alias of the (memoized) command, sharing its config and entries")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv add [--force] [--default-args ARGS] <command>...")
+		fmt.Fprintln(os.Stderr, "       cachenv add --alias NAME <command>")
+		return 1
+	}
+	args = flags.Args()
+	if *defaultArgs != "" && len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "--default-args can only be used when adding a single command.")
 		return 1
 	}
 
@@ -540,49 +1663,223 @@ func handleAdd(args []string) int {
 		return 1
 	}
 
-	cmdName := args[0]
-	if c.IsCommandMemoized(cmdName) {
-		fmt.Fprintf(os.Stderr, "Command '%s' is already memoized.\n", cmdName)
-		return 1
+	if *alias != "" {
+		if len(args) > 1 {
+			fmt.Fprintln(os.Stderr, "--alias can only be used with a single command.")
+			return 1
+		}
+		return c.addAlias(*alias, args[0])
+	}
+
+	type candidate struct {
+		name   string
+		config store.CommandConfig
+	}
+	var candidates []candidate
+	for _, arg := range args {
+		// A command given by path is named after the executable, and runs it
+		// rather than whatever is found in PATH
+		cmdName, cmdConfig := arg, store.CommandConfig{DefaultArgs: strings.Fields(*defaultArgs)}
+		if strings.Contains(arg, "/") {
+			path, err := filepath.Abs(arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error resolving '%s': %v\n", arg, err)
+				continue
+			}
+			if err := checkExecutable(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding command: %v\n", err)
+				continue
+			}
+			cmdName, cmdConfig.Path = filepath.Base(path), path
+		}
+		if SHELL_BUILTINS[arg] && !*force {
+			fmt.Fprintf(os.Stderr, "Command '%s' is a shell builtin, which the shell runs itself without consulting PATH, so cachenv can't intercept it.\n", arg)
+			fmt.Fprintf(os.Stderr, "Use 'cachenv add --force %s' to memoize the external %s (e.g. for scripts which run it via env).\n", arg, arg)
+			continue
+		}
+		if cmdConfig.Path == "" {
+			if _, err := exec.LookPath(cmdName); err != nil {
+				fmt.Fprintf(os.Stderr, "Command '%s' not found in PATH.\n", cmdName)
+				continue
+			}
+		}
+		candidates = append(candidates, candidate{cmdName, cmdConfig})
 	}
 
-	c.Config.Commands[cmdName] = CommandConfig{}
-	configFile, err := os.Create(c.ConfigPath)
+	var added []string
+	err = c.UpdateConfig(func(config *store.Config) bool {
+		for _, cand := range candidates {
+			if _, ok := config.Commands[cand.name]; ok {
+				infof("Command '%s' is already memoized; skipping.\n", cand.name)
+				continue
+			}
+			config.Commands[cand.name] = cand.config
+			added = append(added, cand.name)
+		}
+		return len(added) > 0
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening config file: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		return 1
+	}
+	if len(added) == 0 {
 		return 1
 	}
-	defer configFile.Close()
 
-	encoder := yaml.NewEncoder(configFile)
-	if err := encoder.Encode(c.Config); err != nil {
-		fmt.Fprintf(os.Stderr, "Error encoding config: %v\n", err)
+	for _, cmdName := range added {
+		infof("Command '%s' added to memoized commands.\n", cmdName)
+		if err := c.RefreshLinksFor(cmdName); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating symlinks: %v\n", err)
+		}
+	}
+
+	return 0
+}
+
+// Adds alias as another name for the memoized command target, as 'cachenv add
+// --alias' does, and links it into the PATH
+func (c *Cachenv) addAlias(alias, target string) int {
+	if strings.Contains(alias, "/") || alias == "cachenv" {
+		fmt.Fprintf(os.Stderr, "Invalid alias name '%s'.\n", alias)
 		return 1
 	}
 
-	fmt.Fprintf(os.Stderr, "Command '%s' added to memoized commands.\n", cmdName)
+	var problem string
+	err := c.UpdateConfig(func(config *store.Config) bool {
+		target = config.Canonical(target)
+		if _, ok := config.Commands[target]; !ok {
+			problem = fmt.Sprintf("Command '%s' is not memoized; add it first.", target)
+		} else if _, ok := config.Commands[alias]; ok {
+			problem = fmt.Sprintf("'%s' is already a memoized command.", alias)
+		} else if existing, ok := config.Aliases[alias]; ok {
+			problem = fmt.Sprintf("'%s' is already an alias of '%s'.", alias, existing)
+		}
+		if problem != "" {
+			return false
+		}
+		if config.Aliases == nil {
+			config.Aliases = make(map[string]string)
+		}
+		config.Aliases[alias] = target
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		return 1
+	}
+	if problem != "" {
+		fmt.Fprintln(os.Stderr, problem)
+		return 1
+	}
 
-	if err := c.RefreshLinksFor(cmdName); err != nil {
+	infof("Alias '%s' added for '%s'.\n", alias, target)
+	if err := c.RefreshLinksFor(alias); err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating symlinks: %v\n", err)
 		return 1
 	}
+	return 0
+}
+
+// Stops memoizing a command: the inverse of 'cachenv add'. Cached entries are
+// left in place.
+func handleUnadd(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv unadd <command>")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	// Removing a command also removes its aliases
+	cmdName := args[0]
+	memoized, isAlias := false, false
+	var aliases []string
+	err = c.UpdateConfig(func(config *store.Config) bool {
+		if _, isAlias = config.Aliases[cmdName]; isAlias {
+			delete(config.Aliases, cmdName)
+			return true
+		}
+		if _, memoized = config.Commands[cmdName]; !memoized {
+			return false
+		}
+		delete(config.Commands, cmdName)
+		aliases = nil
+		for alias, target := range config.Aliases {
+			if target == cmdName {
+				aliases = append(aliases, alias)
+				delete(config.Aliases, alias)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+		return 1
+	}
+	if !memoized && !isAlias {
+		fmt.Fprintf(os.Stderr, "Command '%s' is not memoized.\n", cmdName)
+		return 1
+	}
+
+	if isAlias {
+		infof("Alias '%s' removed.\n", cmdName)
+	} else {
+		infof("Command '%s' removed from memoized commands.\n", cmdName)
+	}
+
+	for _, name := range append([]string{cmdName}, aliases...) {
+		if err := c.RemoveLinksFor(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing symlinks: %v\n", err)
+			return 1
+		}
+	}
 
 	return 0
 }
 
-// Returns the hash ID for the provided cached command (+ args)
+// Returns the hash ID for the provided cached command (+ args), computed the
+// same way as when the command is intercepted
 func handleKey(args []string) int {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: cachenv key <command>")
+	flags := flag.NewFlagSet("key", flag.ContinueOnError)
+	raw := flags.Bool("raw", false, "hash only the command and args, ignoring stdin and config")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv key [--raw] <command> [arguments]")
+		return 1
+	}
+	args = flags.Args()
+
+	if *raw {
+		fmt.Println(store.KeyFrom(args[0], args[1:]).Hash)
+		return 0
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	stdin, err := c.StdinFor(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return 1
+	}
+
+	key, err := c.KeyFor(args[0], args[1:], stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
 		return 1
 	}
-	fmt.Println(KeyFrom(args[0], args[1:]).Hash)
+	fmt.Println(key.Hash)
 	return 0
 }
 
-// Like touch(1), creates an empty cache entry, or updates the timestamp of an
-// existing on cache entry.
-// TODO: actually do the latter
+// Like touch(1), creates an empty cache entry, or updates the timestamps of an
+// existing cache entry without changing its contents.
 func handleTouch(args []string) int {
 	if len(args) < 1 {
 		fmt.Fprintln(os.Stderr, "Usage: cachenv touch <command>")
@@ -602,8 +1899,24 @@ func handleTouch(args []string) int {
 		return 1
 	}
 
-	key := KeyFrom(command, args[1:])
-	err = c.Store.WriteToCache(key, ExecResult{})
+	stdin, err := c.StdinFor(command)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return 1
+	}
+
+	// Key the same way as interception does, so that the entry touched is the
+	// one the next invocation will hit
+	key, err := c.KeyFor(command, args[1:], stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
+		return 1
+	}
+	if c.FS.Exists(key) {
+		err = c.FS.Touch(key)
+	} else {
+		err = c.FS.WriteToCache(key, store.ExecResult{})
+	}
 	fmt.Println(key.Hash)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to write to cache: %v\n", err)
@@ -612,12 +1925,18 @@ func handleTouch(args []string) int {
 	return 0
 }
 
-// Run the real command and print `diff -u <cached> <actual>`
+// Run the real command and print a unified diff of its cached and actual
+// stdout. Like diff(1), exits 1 if they differ.
 func handleDiff(args []string) int {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: cachenv diff <command>")
+	usage := "Usage: cachenv diff [--color] [--context N] <command> [arguments]"
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	color := flags.Bool("color", false, "colorize the diff")
+	context := flags.Int("context", 3, "number of context lines")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, usage)
 		return 1
 	}
+	args = flags.Args()
 
 	c, err := loadActiveCachenv()
 	if err != nil {
@@ -625,45 +1944,147 @@ func handleDiff(args []string) int {
 		return 1
 	}
 
-	// Run the real command and pipe its output to diff
-	cmd := c.PrepareRealCommand(args[0], args[1:]...)
+	stdin, err := c.StdinFor(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return 1
+	}
+
+	// Key the same way as interception does, so that e.g. flags added by an
+	// alias and listed in ignore_args still find the entry
+	args[0] = c.Config.Canonical(args[0])
+	key, err := c.KeyFor(args[0], args[1:], stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
+		return 1
+	}
+	if !c.Store.Exists(key) {
+		fmt.Fprintf(os.Stderr, "No cached entry for this command+args (key %s).\n", key.Hash)
+		return 1
+	}
+
+	if diffTool := c.DiffTool(); diffTool != "" {
+		return c.runDiffTool(diffTool, key, stdin, args[0], c.ArgsFor(args[0], args[1:]))
+	}
+
+	cached, err := c.Store.ReadFromCache(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cached output: %v\n", err)
+		return 1
+	}
+
+	// Redact the actual output as the cached output was, so that redacted
+	// parts don't show up as changes
+	redactor, err := c.RedactorFor(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+	actual, err := c.ExecuteRealCommand(ExecOptions{
+		Stdin:    stdin,
+		Stderr:   os.Stderr,
+		Redactor: redactor,
+		Env:      c.EnvFor(args[0]),
+	}, args[0], c.ArgsFor(args[0], args[1:])...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
+		return 1
+	}
+
+	if writeUnifiedDiff(os.Stdout, "cached", "actual", cached.Stdout, actual.Stdout, *context, *color) {
+		return 1
+	}
+	return 0
+}
+
+// Returns the external diff tool to use, if any
+func (c *Cachenv) DiffTool() string {
+	if tool, ok := os.LookupEnv("CACHENV_DIFF"); ok {
+		return strings.TrimSpace(tool)
+	}
+	return strings.TrimSpace(c.Config.DiffTool)
+}
+
+// Runs the real command and pipes its stdout to diffTool, which is passed the
+// path of the cached stdout and "-". Returns diffTool's exit code.
+func (c *Cachenv) runDiffTool(diffTool string, key store.CacheKey, stdin []byte, cmdName string, args []string) int {
+	// Check the tool exists before running the real command for nothing
+	toolArgs := strings.Fields(diffTool)
+	if _, err := exec.LookPath(toolArgs[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Diff tool '%s' not found: %v\n", toolArgs[0], err)
+		return 1
+	}
+
+	cachedPath, cleanup, err := c.FS.StdoutFile(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cached output: %v\n", err)
+		return 1
+	}
+	defer cleanup()
+
+	cmd, err := c.PrepareRealCommand(context.Background(), cmdName, args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
+		return 1
+	}
+	cmd.Stdin = os.Stdin
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if env := c.EnvFor(cmdName); env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating pipe for '%s': %v\n", args[0], err)
+		fmt.Fprintf(os.Stderr, "Error creating pipe for '%s': %v\n", cmdName, err)
 		return 1
 	}
 	cmd.Stderr = os.Stderr
 
-	key := KeyFrom(args[0], args[1:])
-	diffCmd := exec.Command("diff", c.Store.stdoutPath(key), "-")
-
+	diffCmd := exec.Command(toolArgs[0], append(toolArgs[1:], cachedPath, "-")...)
 	diffCmd.Stdin = stdoutPipe
 	diffCmd.Stdout = os.Stdout
 	diffCmd.Stderr = os.Stderr
 
 	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error starting '%s': %v\n", args[0], err)
+		fmt.Fprintf(os.Stderr, "Error starting '%s': %v\n", cmdName, err)
 		return 1
 	}
+	defer cmd.Wait()
 
 	if err := diffCmd.Run(); err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			return exitError.ExitCode()
-		} else {
-			fmt.Fprintf(os.Stderr, "Error running diff: %v\n", err)
-			return 1
 		}
+		fmt.Fprintf(os.Stderr, "Error running diff tool: %v\n", err)
+		return 1
 	}
-
 	return 0
 }
 
+// Reports whether the environment variable is set to a true value, e.g. "1"
+func envFlag(name string) bool {
+	switch strings.ToLower(os.Getenv(name)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
 func isCachenvActivated() bool {
 	_, ok := os.LookupEnv("CACHENV")
 	return ok
 }
 
+// Set by the global --dir flag, to operate on a cachenv without activating it
+var dirFlag string
+
+// Returns the directory of the cachenv to operate on: the one given by --dir,
+// otherwise the active one
 func getActiveCachenvDir() (string, error) {
+	if dirFlag != "" {
+		return filepath.Abs(dirFlag)
+	}
 	dir, ok := os.LookupEnv("CACHENV")
 	if !ok {
 		return "", fmt.Errorf("cachenv directory not set; please activate first.")
@@ -671,18 +2092,38 @@ func getActiveCachenvDir() (string, error) {
 	return dir, nil
 }
 
+// Set by the global --config flag, to drive a cachenv with another config
+var configFlag string
+
+// Returns the path of the config for the cachenv in dir: the one given by
+// --config or $CACHENV_CONFIG (e.g. to use different commands in CI),
+// otherwise the cachenv's own
+func configPathFor(dir string) string {
+	path := configFlag
+	if path == "" {
+		path = os.Getenv("CACHENV_CONFIG")
+	}
+	if path == "" {
+		return filepath.Join(dir, CONFIG_NAME)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
 func loadCachenvFromDir(dir string) *Cachenv {
-	return NewCachenv(filepath.Join(dir, CONFIG_NAME), dir)
+	return NewCachenv(configPathFor(dir), dir)
 }
 
 func loadActiveCachenv() (*Cachenv, error) {
 	dir, err := getActiveCachenvDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to find active cachenv: %v\n", err)
+		return nil, fmt.Errorf("failed to find active cachenv: %w", err)
 	}
 	c := loadCachenvFromDir(dir)
 	if err := c.LoadConfig(); err != nil {
-		return nil, fmt.Errorf("failed to load config: %v\n", err)
+		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 	return c, nil
 }
@@ -0,0 +1,655 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+func init() {
+	quiet = true
+}
+
+// Lets tests run this binary as cachenv, e.g. through the links in a
+// cachenv's PATH directory, which lead back to the test executable
+func TestMain(m *testing.M) {
+	if os.Getenv("CACHENV_TEST_MAIN") != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// Returns a command running the link for cmd in c's PATH directory, as
+// though invoked from a shell in which c is activated
+func linkCommand(c *Cachenv, cmd string, args ...string) *exec.Cmd {
+	command := exec.Command(c.LinkInPath(cmd), args...)
+	command.Env = append(os.Environ(), "CACHENV_TEST_MAIN=1", "CACHENV="+c.Dir)
+	return command
+}
+
+// Returns env without the given variables
+func withoutEnv(env []string, names ...string) []string {
+	var kept []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(names, name) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// Creates a cachenv in a temporary directory, memoizing the given commands
+// (which must be in PATH) with their configs
+func newTestCachenv(t *testing.T, commands map[string]store.CommandConfig) *Cachenv {
+	t.Helper()
+	dir := t.TempDir()
+	c := NewCachenv(filepath.Join(dir, CONFIG_NAME), dir)
+	if err := c.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	err := c.UpdateConfig(func(config *store.Config) bool {
+		for cmd, cmdConfig := range commands {
+			if cmdConfig.Path == "" {
+				path, err := exec.LookPath(cmd)
+				if err != nil {
+					t.Skipf("%s not found: %v", cmd, err)
+				}
+				cmdConfig.Path = path
+			}
+			config.Commands[cmd] = cmdConfig
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("UpdateConfig: %v", err)
+	}
+	if err := c.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if err := c.RefreshLinksForAll(); err != nil {
+		t.Fatalf("RefreshLinksForAll: %v", err)
+	}
+	return c
+}
+
+func TestTimeoutExitCode(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{
+		"sleep": {Timeout: 300 * time.Millisecond},
+	})
+
+	started := time.Now()
+	if code := c.HandleMemoizedCommand("sleep", []string{"5"}); code != TIMEOUT_EXIT_CODE {
+		t.Errorf("exit code = %d, want %d", code, TIMEOUT_EXIT_CODE)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("took %s, want about 300ms", elapsed)
+	}
+
+	key, err := c.KeyFor("sleep", []string{"5"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Store.Exists(key) {
+		t.Error("timed out result was cached")
+	}
+}
+
+func TestTouchKeepsOutput(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{
+		"echo": {CwdSensitive: true},
+	})
+	dirFlag = c.Dir
+	t.Cleanup(func() { dirFlag = "" })
+
+	key, err := c.KeyFor("echo", []string{"hi"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FS.WriteToCache(key, store.ExecResult{Stdout: []byte("hi\n")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := handleTouch([]string{"echo", "hi"}); code != 0 {
+		t.Fatalf("touch exited %d", code)
+	}
+
+	result, err := c.FS.ReadFromCache(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "hi\n" {
+		t.Errorf("stdout = %q after touch, want %q", result.Stdout, "hi\n")
+	}
+	keys, err := c.FS.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("touch wrote %d entries, want 1", len(keys))
+	}
+}
+
+func TestRouting(t *testing.T) {
+	argv0 := os.Args[0]
+	t.Cleanup(func() { os.Args[0] = argv0 })
+	for path, expected := range map[string]string{
+		"/usr/local/bin/cachenv":        "cachenv",
+		"/project/.cachenv/bin/git":     "git",
+		"/project/.cachenv/bin/cachenv": "cachenv",
+	} {
+		os.Args[0] = path
+		if actual := invokedName(); actual != expected {
+			t.Errorf("invoked as %s: routed as %q, want %q", path, actual, expected)
+		}
+	}
+
+	if code := handleCachenvSubcommand("no-such-subcommand", nil); code != 1 {
+		t.Errorf("unknown subcommand exited %d, want 1", code)
+	}
+}
+
+func TestFailuresCachedOnlyWithFailureTTL(t *testing.T) {
+	failureTTL := time.Minute
+	for _, test := range []struct {
+		name     string
+		config   store.CommandConfig
+		expected bool
+	}{
+		{"unset", store.CommandConfig{}, false},
+		{"1m", store.CommandConfig{FailureTTL: &failureTTL}, true},
+	} {
+		c := newTestCachenv(t, map[string]store.CommandConfig{"false": test.config})
+		if code := c.HandleMemoizedCommand("false", nil); code != 1 {
+			t.Fatalf("exit code = %d, want 1", code)
+		}
+		key, err := c.KeyFor("false", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached := c.Store.Exists(key); cached != test.expected {
+			t.Errorf("failure_ttl %s: cached = %v, want %v", test.name, cached, test.expected)
+		}
+	}
+}
+
+// Runs fn with stdout redirected to a file, returning what it wrote there
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	fn()
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMemoizedCommandUsesOnlyStore(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	other := &store.FSStore{Dir: t.TempDir()}
+	c.Store, c.FS = other, nil
+
+	for i := 0; i < 2; i++ {
+		var code int
+		out := captureStdout(t, func() { code = c.HandleMemoizedCommand("echo", []string{"hi"}) })
+		if code != 0 || out != "hi\n" {
+			t.Fatalf("run %d: exit code %d, output %q", i, code, out)
+		}
+	}
+	stats, err := other.ReadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("stats = %+v, want 1 hit and 1 miss", stats)
+	}
+}
+
+func TestMemStoreHitAndMiss(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"date": {}})
+	mem := store.NewMemStore()
+	c.Store, c.FS = mem, nil
+
+	first := captureStdout(t, func() { c.HandleMemoizedCommand("date", []string{"+%s%N"}) })
+	if stats := mem.Stats(); stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("after first run, stats = %+v, want 1 miss", stats)
+	}
+	second := captureStdout(t, func() { c.HandleMemoizedCommand("date", []string{"+%s%N"}) })
+	if stats := mem.Stats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("after second run, stats = %+v, want 1 hit and 1 miss", stats)
+	}
+	if first == "" || first != second {
+		t.Errorf("hit replayed %q, want %q", second, first)
+	}
+
+	key, err := c.KeyFor("date", []string{"+%s%N"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mem.ReadMeta(key)
+	if err != nil || meta.Command != "date" {
+		t.Errorf("meta = %+v, %v", meta, err)
+	}
+}
+
+func TestRunPathQualified(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	dirFlag = c.Dir
+	t.Cleanup(func() { dirFlag = "" })
+
+	// The real command, by path, goes through the cache
+	realPath := c.Config.Commands["echo"].Path
+	if out := captureStdout(t, func() { handleRun([]string{realPath, "real"}) }); out != "real\n" {
+		t.Errorf("output = %q", out)
+	}
+	key, err := c.KeyFor("echo", []string{"real"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.FS.Exists(key) {
+		t.Error("real command run by path wasn't cached")
+	}
+
+	// Another program of the same name runs uncached
+	other := filepath.Join(t.TempDir(), "echo")
+	if err := os.WriteFile(other, []byte("#!/bin/sh\necho other\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if out := captureStdout(t, func() { handleRun([]string{other, "x"}) }); out != "other\n" {
+		t.Errorf("output = %q", out)
+	}
+	key, err = c.KeyFor("echo", []string{"x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FS.Exists(key) {
+		t.Error("another program's output was cached as echo's")
+	}
+}
+
+func TestActivateWarnsOnPathQualified(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	realPath := c.Config.Commands["echo"].Path
+
+	// The check sees the command line as written, before expansion
+	script := `source "$1" >/dev/null; ` + realPath + ` qualified >/dev/null; echo bare >/dev/null`
+	cmd := exec.Command(bash, "-c", script, "bash", filepath.Join(c.Dir, "activate"))
+	cmd.Env = os.Environ()
+	for i, kv := range cmd.Env {
+		if strings.HasPrefix(kv, "CACHENV=") {
+			cmd.Env[i] = "CACHENV="
+		}
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	warning := "cachenv: '" + realPath + "' bypasses the cache"
+	if strings.Count(string(out), "bypasses the cache") != 1 || !strings.Contains(string(out), warning) {
+		t.Errorf("output = %q, want one warning for %s", out, realPath)
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "slowcount")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho run >> \"$1\"\nsleep 0.3\necho done\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCachenv(t, map[string]store.CommandConfig{"slowcount": {Path: script}})
+	runs := filepath.Join(dir, "runs")
+
+	const callers = 8
+	codes := make(chan int, callers)
+	captureStdout(t, func() {
+		for i := 0; i < callers; i++ {
+			go func() { codes <- c.HandleMemoizedCommand("slowcount", []string{runs}) }()
+		}
+		for i := 0; i < callers; i++ {
+			if code := <-codes; code != 0 {
+				t.Errorf("exit code %d", code)
+			}
+		}
+	})
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "run"); n != 1 {
+		t.Errorf("command ran %d times across %d callers, want once", n, callers)
+	}
+	stats, err := c.FS.ReadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Misses != 1 || stats.Hits != callers-1 {
+		t.Errorf("stats = %+v, want 1 miss and %d hits", stats, callers-1)
+	}
+}
+
+func TestActivateSetsDir(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	dir, err := filepath.EvalSymlinks(c.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sourced by a relative path from elsewhere, as the script's own location
+	// is what matters
+	script := `PS1='$ '; source "$1" >/dev/null; cd /; echo "$CACHENV"; echo "$PS1"`
+	for _, shell := range []string{"bash", "zsh"} {
+		path, err := exec.LookPath(shell)
+		if err != nil {
+			t.Logf("%s not found", shell)
+			continue
+		}
+		cmd := exec.Command(path, "-c", script, shell, "./activate")
+		cmd.Dir = c.Dir
+		cmd.Env = os.Environ()
+		for i, kv := range cmd.Env {
+			if strings.HasPrefix(kv, "CACHENV=") {
+				cmd.Env[i] = "CACHENV="
+			}
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", shell, err, out)
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("%s: output = %q", shell, out)
+		}
+		if actual, err := filepath.EvalSymlinks(lines[0]); err != nil || actual != dir {
+			t.Errorf("%s: CACHENV = %q, want %q", shell, lines[0], dir)
+		}
+		if prompt := "(" + filepath.Base(c.Dir) + ") $"; lines[1] != prompt {
+			t.Errorf("%s: PS1 = %q, want %q", shell, lines[1], prompt)
+		}
+	}
+}
+
+func TestSingleFlightProcesses(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "slowcount")
+	err := os.WriteFile(script, []byte("#!/bin/sh\necho run >> \"$1\"\nsleep 0.3\necho done\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCachenv(t, map[string]store.CommandConfig{"slowcount": {Path: script}})
+	runs := filepath.Join(dir, "runs")
+
+	const callers = 6
+	var commands []*exec.Cmd
+	for i := 0; i < callers; i++ {
+		cmd := linkCommand(c, "slowcount", runs)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, cmd)
+	}
+	for _, cmd := range commands {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("process failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "run"); n != 1 {
+		t.Errorf("command ran %d times across %d processes, want once", n, callers)
+	}
+}
+
+func TestUnactivatedLink(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	realDir := filepath.Dir(c.Config.Commands["echo"].Path)
+
+	// A stale link in PATH runs the real command, uncached
+	cmd := linkCommand(c, "echo", "hi")
+	cmd.Env = append(withoutEnv(cmd.Env, "CACHENV", "PATH"),
+		"PATH="+c.DirLinksInPath()+string(os.PathListSeparator)+realDir)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if string(out) != "hi\n" {
+		t.Errorf("output = %q, want %q", out, "hi\n")
+	}
+	if keys, err := c.FS.Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("unactivated run was cached: %v, %v", keys, err)
+	}
+
+	// With nothing else to run, it fails rather than crashing
+	cmd = linkCommand(c, "echo", "hi")
+	cmd.Env = append(withoutEnv(cmd.Env, "CACHENV", "PATH"), "PATH="+c.DirLinksInPath())
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != INTERNAL_ERROR_EXIT_CODE {
+		t.Errorf("exited with %v, want code %d", err, INTERNAL_ERROR_EXIT_CODE)
+	}
+}
+
+func TestActivateTwice(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	other := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+
+	// Sourcing the same cachenv again changes nothing; sourcing another is
+	// refused; either way, deactivating restores the original PATH and PS1
+	script := `PS1='$ '; path="$PATH"
+source "$1" >/dev/null; ps1="$PS1"; activated="$PATH"
+source "$1" || exit 10
+[ "$PATH" = "$activated" ] && [ "$PS1" = "$ps1" ] || exit 11
+source "$2" 2>/dev/null && exit 12
+[ "$PATH" = "$activated" ] && [ "$CACHENV" = "$(dirname "$1")" ] || exit 13
+deactivate_cachenv
+[ "$PATH" = "$path" ] && [ "$PS1" = '$ ' ] && [ -z "$CACHENV" ] || exit 14`
+	cmd := exec.Command(bash, "-c", script, "bash", c.ActivateScriptPath(), other.ActivateScriptPath())
+	cmd.Env = withoutEnv(os.Environ(), "CACHENV")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v: %s", err, out)
+	}
+}
+
+func TestAddBuiltin(t *testing.T) {
+	c := newTestCachenv(t, nil)
+	dirFlag = c.Dir
+	t.Cleanup(func() { dirFlag = "" })
+
+	if code := handleAdd([]string{"cd"}); code != 1 {
+		t.Errorf("adding cd exited %d, want 1", code)
+	}
+	if code := handleAdd([]string{"echo"}); code != 1 {
+		t.Errorf("adding echo exited %d, want 1", code)
+	}
+	if code := handleAdd([]string{"--force", "echo"}); code != 0 {
+		t.Errorf("adding echo with --force exited %d, want 0", code)
+	}
+
+	c = loadCachenvFromDir(c.Dir)
+	if err := c.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Config.Commands["cd"]; ok {
+		t.Error("cd was added")
+	}
+	if _, ok := c.Config.Commands["echo"]; !ok {
+		t.Error("echo wasn't added with --force")
+	}
+}
+
+func TestConcurrentAdds(t *testing.T) {
+	c := newTestCachenv(t, nil)
+	names := []string{"cat", "date", "head", "ls", "sort", "tail", "uniq", "wc"}
+	var commands []*exec.Cmd
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+		cmd := exec.Command(c.LinkToRealCachenv(), "--dir", c.Dir, "add", name)
+		cmd.Env = append(os.Environ(), "CACHENV_TEST_MAIN=1")
+		commands = append(commands, cmd)
+	}
+	for _, cmd := range commands {
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cmd := range commands {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("add failed: %v", err)
+		}
+	}
+
+	if err := c.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if _, ok := c.Config.Commands[name]; !ok {
+			t.Errorf("%s was lost from the config", name)
+		}
+	}
+}
+
+func TestUnwritableCache(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"echo": {}})
+	key, err := c.KeyFor("echo", []string{"hi"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		// Root can write to a read-only directory, but not into a file
+		shard := filepath.Dir(c.FS.KeyDir(key))
+		if err := os.MkdirAll(filepath.Dir(shard), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(shard, nil, 0444); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if err := os.Chmod(c.FS.Dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(c.FS.Dir, 0755) })
+	}
+
+	var code int
+	out := captureStdout(t, func() { code = c.HandleMemoizedCommand("echo", []string{"hi"}) })
+	if code != 0 || out != "hi\n" {
+		t.Errorf("exit code %d, output %q; want 0 and %q", code, out, "hi\n")
+	}
+	if c.FS.Exists(key) {
+		t.Error("entry was written")
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "exitwith")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexit \"$1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+	if err := os.WriteFile(missing, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	failureTTL := time.Hour
+	c := newTestCachenv(t, map[string]store.CommandConfig{
+		"exitwith": {Path: script, FailureTTL: &failureTTL},
+		"missing":  {Path: missing},
+	})
+
+	for _, expected := range []int{0, 1, 127, 137, 255} {
+		args := []string{strconv.Itoa(expected)}
+		if code := c.HandleMemoizedCommand("exitwith", args); code != expected {
+			t.Errorf("exit %d: miss exited %d", expected, code)
+		}
+		key, err := c.KeyFor("exitwith", args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, err := c.FS.ReadExitCode(key); err != nil || code != expected {
+			t.Errorf("exit %d: status file has %d, %v", expected, code, err)
+		}
+		if code := c.HandleMemoizedCommand("exitwith", args); code != expected {
+			t.Errorf("exit %d: hit exited %d", expected, code)
+		}
+	}
+
+	stats, err := c.FS.ReadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 5 || stats.Misses != 5 {
+		t.Errorf("stats = %+v, want 5 hits and 5 misses", stats)
+	}
+
+	// Removed after it was memoized
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+	if code := c.HandleMemoizedCommand("missing", nil); code != NOT_FOUND_EXIT_CODE {
+		t.Errorf("missing command exited %d, want %d", code, NOT_FOUND_EXIT_CODE)
+	}
+}
+
+func TestDurationAndReplayDelay(t *testing.T) {
+	for _, replayDelay := range []bool{false, true} {
+		c := newTestCachenv(t, map[string]store.CommandConfig{
+			"sleep": {ReplayDelay: replayDelay},
+		})
+		args := []string{"0.3"}
+		if code := c.HandleMemoizedCommand("sleep", args); code != 0 {
+			t.Fatalf("exit code %d", code)
+		}
+		key, err := c.KeyFor("sleep", args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := c.FS.ReadMeta(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Duration < 300*time.Millisecond || meta.Duration > 3*time.Second {
+			t.Errorf("recorded duration %s, want about 300ms", meta.Duration)
+		}
+		if info, err := c.FS.Info(key); err != nil || info.Duration == "" {
+			t.Errorf("info has no duration: %+v, %v", info, err)
+		}
+
+		started := time.Now()
+		if code := c.HandleMemoizedCommand("sleep", args); code != 0 {
+			t.Fatalf("exit code %d on hit", code)
+		}
+		if elapsed := time.Since(started); replayDelay && elapsed < meta.Duration {
+			t.Errorf("hit with replay_delay took %s, want at least %s", elapsed, meta.Duration)
+		} else if !replayDelay && elapsed >= 300*time.Millisecond {
+			t.Errorf("hit took %s, want it immediate", elapsed)
+		}
+	}
+}
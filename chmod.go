@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/* Permissions */
+
+// Applies the configured permissions (see cache.private) to existing entries,
+// which keep the permissions they were written with
+func handleChmod(args []string) int {
+	flags := flag.NewFlagSet("chmod", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv chmod")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	changed, err := c.FS.Chmod()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error changing permissions: %v\n", err)
+		return 1
+	}
+	infof("Changed permissions of %d files and directories.\n", changed)
+	return 0
+}
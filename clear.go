@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Clearing */
+
+// Asks the user a yes/no question on stderr, reading the answer from stdin.
+// Anything other than "y" or "yes" counts as no.
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Adds the flags shared by the subcommands which remove entries
+func addRemoveFlags(flags *flag.FlagSet) (yes *bool, dryRun *bool) {
+	yes = flags.Bool("yes", false, "don't ask for confirmation")
+	dryRun = flags.Bool("dry-run", false, "only report what would be removed")
+	return yes, dryRun
+}
+
+// Removes the entries with keys, as clear, prune and rm do, so that they all
+// behave alike: unless yes, the user is asked to confirm first, with the
+// number of entries and the space removing them would free; with dryRun, the
+// entries are only listed. Each removed entry's hash is printed. Returns the
+// exit code.
+func (c *Cachenv) removeEntries(keys []store.CacheKey, yes bool, dryRun bool) int {
+	if len(keys) == 0 {
+		infof("No entries to remove.\n")
+		return 0
+	}
+
+	// Outputs shared with entries which remain aren't freed
+	size, err := c.FS.FreedBy(keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	if dryRun {
+		for _, key := range keys {
+			fmt.Printf("%s  %s\n", key.Hash, entryCommandLine(c, key))
+		}
+		infof("Would remove %d entries, freeing %s.\n", len(keys), formatBytes(size, true))
+		return 0
+	}
+	prompt := fmt.Sprintf("Remove %d entries from %s, freeing %s?", len(keys), c.FS.Dir, formatBytes(size, true))
+	if !yes && !confirm(prompt) {
+		fmt.Fprintln(os.Stderr, "Aborted.")
+		return 1
+	}
+
+	var freed int64
+	for _, key := range keys {
+		bytes, err := c.FS.RemoveFreeing(key)
+		freed += bytes
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing entry: %v\n", err)
+			return 1
+		}
+		fmt.Println(key.Hash)
+	}
+
+	// Drop the removed entries from the index
+	if err := c.FS.Reindex(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating cache index: %v\n", err)
+		return 1
+	}
+
+	infof("Removed %d entries, freeing %s.\n", len(keys), formatBytes(freed, true))
+	return 0
+}
+
+// Removes all entries from the cache, or only those for a given command
+func handleClear(args []string) int {
+	flags := flag.NewFlagSet("clear", flag.ContinueOnError)
+	command := flags.String("command", "", "only remove entries for this command")
+	yes, dryRun := addRemoveFlags(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv clear [--command <name>] [--yes] [--dry-run]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	var keys []store.CacheKey
+	if *command != "" {
+		keys, err = c.FS.KeysForCommand(*command)
+	} else {
+		keys, err = c.FS.Keys()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	return c.removeEntries(keys, *yes, *dryRun)
+}
+
+// Hashes given by repeated --hash flags
+type hashList []string
+
+func (h *hashList) String() string {
+	return strings.Join(*h, ",")
+}
+
+func (h *hashList) Set(hash string) error {
+	*h = append(*h, hash)
+	return nil
+}
+
+// Removes the entry for a single invocation, or those with the given hashes
+// (or unambiguous prefixes of them).
+// Arguments after --hash are hashes too, so that 'cachenv keys | xargs
+// cachenv rm --yes --hash' removes everything listed.
+func handleRm(args []string) int {
+	usage := "Usage: cachenv rm [--yes] [--dry-run] <command> [arguments] | --hash <hash>..."
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	yes, dryRun := addRemoveFlags(flags)
+	var hashes hashList
+	flags.Var(&hashes, "hash", "remove the entry with this hash (repeatable)")
+	if err := flags.Parse(args); err != nil || (len(hashes) == 0 && flags.NArg() == 0) {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	args = flags.Args()
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	var keys []store.CacheKey
+	if len(hashes) > 0 {
+		// Hashes may be abbreviated, as in list's output
+		for _, hash := range append(hashes, args...) {
+			key, err := c.FS.ResolvePrefix(hash)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+				return 1
+			}
+			keys = append(keys, key)
+		}
+	} else {
+		stdin, err := c.StdinFor(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			return 1
+		}
+		key, err := c.KeyFor(args[0], args[1:], stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
+			return 1
+		}
+		if !c.FS.Exists(key) {
+			fmt.Fprintf(os.Stderr, "No cached entry with key %s.\n", key.Hash)
+			return 1
+		}
+		keys = append(keys, key)
+	}
+
+	return c.removeEntries(keys, *yes, *dryRun)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+func TestRmHashes(t *testing.T) {
+	c := newTestCachenv(t, nil)
+	dirFlag = c.Dir
+	t.Cleanup(func() { dirFlag = "" })
+	hashes := []string{
+		strings.Repeat("a", 64), strings.Repeat("b", 64),
+		strings.Repeat("c", 64), strings.Repeat("d", 64),
+	}
+	for _, hash := range hashes {
+		seedEntry(t, c, hash, "echo", 100)
+	}
+
+	// As from xargs: several hashes after --hash
+	captureStdout(t, func() {
+		if code := handleRm([]string{"--yes", "--hash", hashes[0], hashes[1]}); code != 0 {
+			t.Errorf("rm --hash with two hashes exited %d", code)
+		}
+		if code := handleRm([]string{"--yes", "--hash", hashes[2], "--hash", hashes[3][:8]}); code != 0 {
+			t.Errorf("rm with repeated --hash exited %d", code)
+		}
+	})
+	for _, hash := range hashes {
+		if c.FS.Exists(store.CacheKey{Hash: hash}) {
+			t.Errorf("entry %s wasn't removed", hash)
+		}
+	}
+}
+
+func TestRmHashPrefix(t *testing.T) {
+	c := newTestCachenv(t, nil)
+	dirFlag = c.Dir
+	t.Cleanup(func() { dirFlag = "" })
+	first, second := "ab"+strings.Repeat("0", 62), "ab"+strings.Repeat("1", 62)
+	seedEntry(t, c, first, "echo", 100)
+	seedEntry(t, c, second, "echo", 100)
+
+	if code := handleRm([]string{"--yes", "--hash", "ab"}); code != 1 {
+		t.Errorf("rm with an ambiguous prefix exited %d, want 1", code)
+	}
+	if code := handleRm([]string{"--yes", "--hash", "ff"}); code != 1 {
+		t.Errorf("rm with an unmatched prefix exited %d, want 1", code)
+	}
+	if !c.FS.Exists(store.CacheKey{Hash: first}) || !c.FS.Exists(store.CacheKey{Hash: second}) {
+		t.Fatal("a failed rm removed entries")
+	}
+
+	captureStdout(t, func() {
+		if code := handleRm([]string{"--yes", "--hash", "ab1"}); code != 0 {
+			t.Errorf("rm with a unique prefix exited %d", code)
+		}
+	})
+	if !c.FS.Exists(store.CacheKey{Hash: first}) || c.FS.Exists(store.CacheKey{Hash: second}) {
+		t.Error("rm with a unique prefix removed the wrong entry")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Comparing caches */
+
+// Loads the cachenv in dir, e.g. one which isn't active
+func loadCachenvForCompare(dir string) (*Cachenv, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := loadCachenvFromDir(dir)
+	if err := c.LoadConfig(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns the entries of c, by hash
+func entriesByHash(c *Cachenv) (map[string]store.CacheKey, error) {
+	keys, err := c.FS.Keys()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]store.CacheKey, len(keys))
+	for _, key := range keys {
+		entries[key.Hash] = key
+	}
+	return entries, nil
+}
+
+// Returns the command line recorded for the entry, or "?" if unknown
+func entryCommandLine(c *Cachenv, key store.CacheKey) string {
+	meta, err := c.FS.ReadMeta(key)
+	if err != nil || meta.Command == "" {
+		return "?"
+	}
+	return meta.CommandLine()
+}
+
+// Compares the caches of two cachenvs (e.g. from different machines): entries
+// present in both whose stdout, stderr or exit code differ, and entries only
+// in one. Exits 1 if there are any differences, like diff(1).
+func handleCompare(args []string) int {
+	usage := "Usage: cachenv compare [--names-only] [--color] [--context N] <dirA> <dirB>"
+	flags := flag.NewFlagSet("compare", flag.ContinueOnError)
+	namesOnly := flags.Bool("names-only", false, "only list the differing entries")
+	color := flags.Bool("color", false, "colorize the diffs")
+	context := flags.Int("context", 3, "number of context lines")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	dirA, dirB := flags.Arg(0), flags.Arg(1)
+
+	var cachenvs [2]*Cachenv
+	var entries [2]map[string]store.CacheKey
+	for i, dir := range []string{dirA, dirB} {
+		c, err := loadCachenvForCompare(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading cachenv %s: %v\n", dir, err)
+			return 1
+		}
+		if entries[i], err = entriesByHash(c); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading cache %s: %v\n", dir, err)
+			return 1
+		}
+		cachenvs[i] = c
+	}
+	a, b := cachenvs[0], cachenvs[1]
+	// Any key will do to tell whether the hash settings are equivalent
+	if a.Config.Hash.KeyFrom("", nil).Hash != b.Config.Hash.KeyFrom("", nil).Hash {
+		fmt.Fprintf(os.Stderr, "Warning: the cachenvs hash keys differently, so no entries will match.\n")
+	}
+
+	var shared, onlyA, onlyB []string
+	for hash := range entries[0] {
+		if _, ok := entries[1][hash]; ok {
+			shared = append(shared, hash)
+		} else {
+			onlyA = append(onlyA, hash)
+		}
+	}
+	for hash := range entries[1] {
+		if _, ok := entries[0][hash]; !ok {
+			onlyB = append(onlyB, hash)
+		}
+	}
+	sort.Strings(shared)
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+
+	differing := 0
+	for _, hash := range shared {
+		keyA, keyB := entries[0][hash], entries[1][hash]
+		resultA, err := a.FS.ReadFromCache(keyA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading entry %s in %s: %v\n", hash, dirA, err)
+			return 1
+		}
+		resultB, err := b.FS.ReadFromCache(keyB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading entry %s in %s: %v\n", hash, dirB, err)
+			return 1
+		}
+		if bytes.Equal(resultA.Stdout, resultB.Stdout) &&
+			bytes.Equal(resultA.Stderr, resultB.Stderr) &&
+			resultA.ExitCode == resultB.ExitCode {
+			continue
+		}
+		differing++
+
+		fmt.Printf("Differs: %s  %s\n", hash, entryCommandLine(a, keyA))
+		if *namesOnly {
+			continue
+		}
+		writeUnifiedDiff(os.Stdout, dirA+"/out", dirB+"/out", resultA.Stdout, resultB.Stdout, *context, *color)
+		writeUnifiedDiff(os.Stdout, dirA+"/err", dirB+"/err", resultA.Stderr, resultB.Stderr, *context, *color)
+		if resultA.ExitCode != resultB.ExitCode {
+			fmt.Printf("Exit code: %d in %s, %d in %s\n", resultA.ExitCode, dirA, resultB.ExitCode, dirB)
+		}
+		fmt.Println()
+	}
+	for _, hash := range onlyA {
+		fmt.Printf("Only in %s: %s  %s\n", dirA, hash, entryCommandLine(a, entries[0][hash]))
+	}
+	for _, hash := range onlyB {
+		fmt.Printf("Only in %s: %s  %s\n", dirB, hash, entryCommandLine(b, entries[1][hash]))
+	}
+
+	infof("Compared %d shared entries; %d differ, %d only in %s, %d only in %s.\n",
+		len(shared), differing, len(onlyA), dirA, len(onlyB), dirB)
+	if differing > 0 || len(onlyA) > 0 || len(onlyB) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Deactivation */
+
+// Prints shell code which deactivates the active cachenv, for use as
+// 'eval "$(cachenv deactivate)"'. A subprocess can't change its parent
+// shell's environment, so this serves when the deactivate_cachenv and cachenv
+// shell functions are missing (e.g. were clobbered, or in a child shell).
+func handleDeactivate(args []string) int {
+	flags := flag.NewFlagSet("deactivate", flag.ContinueOnError)
+	fish := flags.Bool("fish", false, "print fish rather than bash/zsh code")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv deactivate [--fish]")
+		return 1
+	}
+
+	dir, err := getActiveCachenvDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	// Remove our links from PATH rather than restoring the PATH saved on
+	// activation, which may be missing or outdated
+	c := loadCachenvFromDir(dir)
+	var path []string
+	for _, entry := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.Clean(entry) != filepath.Clean(c.DirLinksInPath()) {
+			path = append(path, entry)
+		}
+	}
+	prefix := "(" + filepath.Base(dir) + ") "
+
+	if *fish {
+		fmt.Printf(`set -gx PATH %s
+set -e _CACHENV_OLD_PATH _CACHENV_EXECUTABLE CACHENV
+if functions -q _cachenv_old_fish_prompt
+    functions -e fish_prompt
+    functions -c _cachenv_old_fish_prompt fish_prompt
+    functions -e _cachenv_old_fish_prompt
+end
+functions -e cachenv deactivate_cachenv
+`, strings.Join(shellQuoteAll(path), " "))
+		return 0
+	}
+
+	fmt.Printf(`export PATH=%s
+unset _CACHENV_OLD_PATH _CACHENV_EXECUTABLE CACHENV _CACHENV_DEBUG_TRAP
+if [ -n "${ZSH_VERSION-}" ]; then
+    add-zsh-hook -d preexec _cachenv_check_bypass 2>/dev/null
+fi
+unset -f deactivate_cachenv cachenv _cachenv_check_bypass 2>/dev/null
+hash -r 2>/dev/null
+if [ -n "${_CACHENV_OLD_PS1+_}" ]; then
+    PS1="$_CACHENV_OLD_PS1"
+    unset _CACHENV_OLD_PS1
+else
+    PS1=${PS1#%s}
+fi
+export PS1
+`, shellQuote(strings.Join(path, string(filepath.ListSeparator))), shellQuote(prefix))
+	return 0
+}
+
+// Quotes s for use as a single word in sh or fish
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellQuoteAll(words []string) []string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = shellQuote(word)
+	}
+	return quoted
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+/* Line diffs */
+
+// Beyond this many edits, stop searching for a minimal diff and report the
+// differing region as replaced wholesale, bounding time and memory
+const MAX_DIFF_EDITS = 2000
+
+const (
+	ANSI_RED   = "\x1b[31m"
+	ANSI_GREEN = "\x1b[32m"
+	ANSI_CYAN  = "\x1b[36m"
+	ANSI_RESET = "\x1b[0m"
+)
+
+// One line of an edit script: kept (' '), removed ('-'), or added ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// Reports whether data looks like text rather than binary content
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// Splits data into lines, each keeping its newline, so that a final line
+// lacking one differs from the same line with one, as in diff(1)
+func splitLinesAfter(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Returns an edit script transforming a into b
+func diffLines(a, b []string) []diffOp {
+	// Common prefix and suffix are kept as-is; only diff what's between
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// Computes a minimal edit script using Myers' O(ND) algorithm, falling back
+// to a wholesale replacement beyond MAX_DIFF_EDITS edits
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	maxEdits := n + m
+	if maxEdits > MAX_DIFF_EDITS {
+		maxEdits = MAX_DIFF_EDITS
+	}
+	offset := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+
+	// trace[d] holds the furthest x reached on diagonals -d-1..d+1 before
+	// round d, which is all that backtracking through round d needs
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxEdits && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		var ops []diffOp
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+
+	// Walk back from the end to recover the path, collecting ops in reverse
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v, offset := trace[d], d+1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', b[y-1]})
+				y--
+			} else {
+				ops = append(ops, diffOp{'-', a[x-1]})
+				x--
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Writes a unified diff of a and b with the given number of context lines.
+// Returns whether they differ.
+func writeUnifiedDiff(w io.Writer, aName, bName string, a, b []byte, context int, color bool) bool {
+	if bytes.Equal(a, b) {
+		return false
+	}
+	if !isText(a) || !isText(b) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", aName, bName)
+		return true
+	}
+
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return code + s + ANSI_RESET
+	}
+
+	ops := diffLines(splitLinesAfter(a), splitLinesAfter(b))
+	fmt.Fprintln(w, paint(ANSI_RED, "--- "+aName))
+	fmt.Fprintln(w, paint(ANSI_GREEN, "+++ "+bName))
+
+	// Line numbers (1-based) in a and b at which each op applies
+	aLines := make([]int, len(ops)+1)
+	bLines := make([]int, len(ops)+1)
+	aLines[0], bLines[0] = 1, 1
+	for i, op := range ops {
+		aLines[i+1], bLines[i+1] = aLines[i], bLines[i]
+		if op.kind != '+' {
+			aLines[i+1]++
+		}
+		if op.kind != '-' {
+			bLines[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); i++ {
+		if ops[i].kind == ' ' {
+			continue
+		}
+
+		// Extend the hunk through subsequent changes separated by no more
+		// than twice the context, then pad it with context
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				end += context
+				if end > len(ops) {
+					end = len(ops)
+				}
+				break
+			}
+			end = run
+		}
+
+		aStart, aCount := aLines[start], aLines[end]-aLines[start]
+		bStart, bCount := bLines[start], bLines[end]-bLines[start]
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintln(w, paint(ANSI_CYAN, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aCount, bStart, bCount)))
+		for _, op := range ops[start:end] {
+			line := string(op.kind) + strings.TrimSuffix(op.line, "\n")
+			switch op.kind {
+			case '-':
+				line = paint(ANSI_RED, line)
+			case '+':
+				line = paint(ANSI_GREEN, line)
+			}
+			fmt.Fprintln(w, line)
+			if !strings.HasSuffix(op.line, "\n") {
+				fmt.Fprintln(w, "\\ No newline at end of file")
+			}
+		}
+		i = end - 1
+	}
+	return true
+}
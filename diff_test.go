@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnifiedDiffMissingNewline(t *testing.T) {
+	var buf bytes.Buffer
+	if !writeUnifiedDiff(&buf, "a", "b", []byte("one\ntwo\n"), []byte("one\ntwo"), 3, false) {
+		t.Fatal("expected a difference")
+	}
+	expected := `--- a
++++ b
+@@ -1,2 +1,2 @@
+ one
+-two
++two
+\ No newline at end of file
+`
+	if buf.String() != expected {
+		t.Errorf("diff =\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var buf bytes.Buffer
+	writeUnifiedDiff(&buf, "a", "b", []byte("1\n2\n3\n"), []byte("1\nX\n3\n"), 1, false)
+	expected := `--- a
++++ b
+@@ -1,3 +1,3 @@
+ 1
+-2
++X
+ 3
+`
+	if buf.String() != expected {
+		t.Errorf("diff =\n%s\nexpected\n%s", buf.String(), expected)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/* Garbage collection */
+
+// Removes output blobs no longer referenced by any entry, staging
+// directories left behind by interrupted writes, and lock files of removed
+// entries
+func handleGC(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv gc")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	// Staging directories go first, as they may hold the only links to blobs
+	staged, err := c.FS.GCStaging()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing stale staging directories: %v\n", err)
+		return 1
+	}
+	if staged > 0 {
+		infof("Removed %d stale staging directories.\n", staged)
+	}
+
+	locks, err := c.FS.GCLocks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing unused lock files: %v\n", err)
+		return 1
+	}
+	if locks > 0 {
+		infof("Removed %d unused lock files.\n", locks)
+	}
+
+	removed, err := c.FS.GCBlobs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error collecting blobs: %v\n", err)
+		return 1
+	}
+	infof("Removed %d unreferenced blobs.\n", removed)
+	return 0
+}
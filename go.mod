@@ -2,4 +2,9 @@ module github.com/aromatt/cachenv
 
 go 1.21.5
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	golang.org/x/crypto v0.21.0
+	golang.org/x/sys v0.18.0
+	golang.org/x/term v0.18.0
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+/* Searching cached output */
+
+// Searches every entry's cached stdout (and with --stderr, its stderr) for a
+// regular expression, without running anything. Prints each matching entry
+// with its command and matching lines, or with -l just the entries. Exits 1
+// if nothing matches.
+func handleGrep(args []string) int {
+	usage := "Usage: cachenv grep [-l] [-i] [--stderr] <pattern>"
+	flags := flag.NewFlagSet("grep", flag.ContinueOnError)
+	namesOnly := flags.Bool("l", false, "only list the matching entries")
+	ignoreCase := flags.Bool("i", false, "match case-insensitively")
+	searchStderr := flags.Bool("stderr", false, "search stderr too")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	pattern := flags.Arg(0)
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid pattern: %v\n", err)
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	keys, err := c.FS.Keys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	matched := 0
+	for _, key := range keys {
+		result, err := c.FS.ReadFromCache(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping unreadable entry %s: %v\n", key.Hash, err)
+			continue
+		}
+		type stream struct {
+			name string
+			data []byte
+		}
+		streams := []stream{{"out", result.Stdout}}
+		if *searchStderr {
+			streams = append(streams, stream{"err", result.Stderr})
+		}
+
+		var matches []string
+		for _, stream := range streams {
+			if !re.Match(stream.data) {
+				continue
+			}
+			if !isText(stream.data) {
+				matches = append(matches, fmt.Sprintf("%s: binary output matches", stream.name))
+				continue
+			}
+			for n, line := range splitLines(stream.data) {
+				if re.MatchString(line) {
+					matches = append(matches, fmt.Sprintf("%s:%d: %s", stream.name, n+1, line))
+				}
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		matched++
+
+		fmt.Printf("%s  %s\n", key.Hash, entryCommandLine(c, key))
+		if *namesOnly {
+			continue
+		}
+		for _, match := range matches {
+			fmt.Printf("  %s\n", match)
+		}
+	}
+
+	if matched == 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/* Link inspection and repair */
+
+// Prints the real executable which a memoized command runs, following its
+// symlink in links-to-real. Warns if the command isn't memoized or its link is
+// missing or dangling.
+func handleWhich(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv which <command>")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	cmdName := args[0]
+	if !c.IsCommandMemoized(cmdName) {
+		fmt.Fprintf(os.Stderr, "Warning: command '%s' is not memoized.\n", cmdName)
+		return 1
+	}
+
+	target, err := readLink(c.LinkToReal(cmdName))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: no link to the real '%s'; run 'cachenv link' to create it.\n", cmdName)
+		return 1
+	}
+	realPath, err := filepath.EvalSymlinks(c.RealExecutable(cmdName))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: link to the real '%s' is dangling (points to %s).\n", cmdName, target)
+		return 1
+	}
+	fmt.Println(realPath)
+
+	// The link is made when the command is added, so PATH may since have
+	// changed to find another version first
+	if current, ok := lookPathSkippingSelf(cmdName); ok && !c.IsRealCommand(current, cmdName) {
+		fmt.Fprintf(os.Stderr, "Warning: '%s' in PATH is now %s; run 'cachenv link' to use it.\n", cmdName, current)
+	}
+	return 0
+}
+
+// Something wrong with a cachenv's symlinks, and how to repair it
+type linkProblem struct {
+	description string
+	fix         func() error
+}
+
+// Checks the symlinks in links-in-path and links-to-real against the memoized
+// commands: each command needs both links, resolving to cachenv and to the
+// real command respectively, and no other command may have either.
+func (c *Cachenv) auditLinks() ([]linkProblem, error) {
+	var problems []linkProblem
+
+	if _, err := os.Stat(linkExecutable(c.LinkToRealCachenv())); err != nil {
+		problems = append(problems, linkProblem{
+			description: "link to the cachenv executable is missing or dangling",
+			fix: func() error {
+				if err := c.RemoveCachenvLink(); err != nil {
+					return err
+				}
+				return c.CreateCachenvLink()
+			},
+		})
+	}
+
+	for _, cmd := range c.InterceptedNames() {
+		var description string
+		if target, err := readLink(c.LinkInPath(cmd)); err != nil {
+			description = fmt.Sprintf("'%s' has no link in PATH", cmd)
+		} else if target != c.LinkToRealRelative("cachenv") {
+			description = fmt.Sprintf("'%s' has a link in PATH to %s rather than cachenv", cmd, target)
+		} else if _, err := readLink(c.LinkToReal(cmd)); err != nil {
+			description = fmt.Sprintf("'%s' has no link to the real command", cmd)
+		} else if _, err := os.Stat(c.RealExecutable(cmd)); err != nil {
+			description = fmt.Sprintf("'%s' has a dangling link to the real command (uninstalled?)", cmd)
+		} else if c.checkNotSelf(cmd) != nil {
+			description = fmt.Sprintf("'%s' has a link to the real command which leads back to cachenv", cmd)
+		}
+		if description != "" {
+			cmd := cmd
+			problems = append(problems, linkProblem{
+				description: description,
+				fix:         func() error { return c.RefreshLinksFor(cmd) },
+			})
+		}
+	}
+
+	// Links for commands which are no longer memoized
+	stale := make(map[string]bool)
+	for _, dir := range []string{c.DirLinksInPath(), c.DirLinksToReal()} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read links directory: %w", err)
+		}
+		for _, entry := range entries {
+			if name := linkName(entry.Name()); name != "cachenv" && !c.IsCommandMemoized(name) {
+				stale[name] = true
+			}
+		}
+	}
+	for cmd := range stale {
+		cmd := cmd
+		problems = append(problems, linkProblem{
+			description: fmt.Sprintf("'%s' has links but isn't memoized", cmd),
+			fix:         func() error { return c.RemoveLinksFor(cmd) },
+		})
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].description < problems[j].description
+	})
+	return problems, nil
+}
+
+// Reports problems with the active cachenv's symlinks and, with --fix,
+// repairs them. Exits 1 if any problems remain.
+func handleDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "repair the problems found")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv doctor [--fix]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	problems, err := c.auditLinks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking symlinks: %v\n", err)
+		return 1
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(os.Stderr, "No problems found.")
+		return 0
+	}
+
+	remaining := 0
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "Problem: %s\n", problem.description)
+		if !*fix {
+			remaining++
+			continue
+		}
+		if err := problem.fix(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error fixing: %v\n", err)
+			remaining++
+		}
+	}
+
+	if !*fix {
+		fmt.Fprintf(os.Stderr, "Found %d problems; run 'cachenv doctor --fix' to repair them.\n", len(problems))
+	} else {
+		infof("Fixed %d of %d problems.\n", len(problems)-remaining, len(problems))
+	}
+	if remaining > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+/* Links */
+
+// Creates a symlink at link pointing to target
+func makeLink(target, link string) error {
+	return os.Symlink(target, link)
+}
+
+// Returns the target of the symlink at link
+func readLink(link string) (string, error) {
+	return os.Readlink(link)
+}
+
+// Removes the symlink at link, if any
+func removeLink(link string) error {
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Returns the path to execute to run the program link points to. A symlink
+// can be executed directly.
+func linkExecutable(link string) string {
+	return link
+}
+
+// Returns the name of the link stored in a links directory as fileName
+func linkName(fileName string) string {
+	return fileName
+}
+
+// Reports whether path is a shim which invokes cachenv. Shims are only used on
+// Windows; here, symlinks to cachenv are caught by comparing files.
+func isShim(path string) bool {
+	return false
+}
+
+// Reports whether the file described by info may be executed
+func isExecutable(path string, info os.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// Returns the name cachenv was invoked as: "cachenv", or the name of a
+// memoized command whose symlink led here
+func invokedName() string {
+	return filepath.Base(os.Args[0])
+}
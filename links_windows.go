@@ -0,0 +1,149 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/* Links */
+
+// Creating symlinks requires privileges on Windows, and a symlink without an
+// extension couldn't be run from PATH anyway. Instead, a command's link in
+// PATH is a shim, <cmd>.cmd, which runs cachenv and tells it which command
+// it's standing in for. A link to a real executable is a plain file holding
+// its path.
+
+// Extension of shims
+const SHIM_EXT = ".cmd"
+
+// Marks the line of a shim which records its target
+const SHIM_MARKER = "cachenv link to "
+
+// Passes the name of the command a shim stands in for to cachenv, which can't
+// otherwise tell (its argv[0] is cachenv's own)
+const INVOKED_AS_VAR = "CACHENV_INVOKED_AS"
+
+// Creates a link at link pointing to target: a shim if target is cachenv, or
+// else a file holding target
+func makeLink(target, link string) error {
+	if filepath.Base(target) != "cachenv" {
+		return os.WriteFile(link, []byte(target+"\r\n"), 0644)
+	}
+
+	cachenv := target
+	if !filepath.IsAbs(cachenv) {
+		cachenv = filepath.Join(filepath.Dir(link), cachenv)
+	}
+	shim := strings.Join([]string{
+		"@echo off",
+		"setlocal",
+		"rem " + SHIM_MARKER + target,
+		fmt.Sprintf("set %s=%s", INVOKED_AS_VAR, filepath.Base(link)),
+		fmt.Sprintf(`"%s" %%*`, linkExecutable(cachenv)),
+		"exit /b %ERRORLEVEL%",
+		"",
+	}, "\r\n")
+	return os.WriteFile(link+SHIM_EXT, []byte(shim), 0755)
+}
+
+// Returns the target of the link at link, as given to makeLink
+func readLink(link string) (string, error) {
+	if target, err := os.Readlink(link); err == nil {
+		return target, nil
+	}
+	if data, err := os.ReadFile(link + SHIM_EXT); err == nil {
+		for _, line := range strings.Split(string(data), "\r\n") {
+			if target, ok := strings.CutPrefix(line, "rem "+SHIM_MARKER); ok {
+				return target, nil
+			}
+		}
+		return "", fmt.Errorf("%s%s is not a cachenv shim", link, SHIM_EXT)
+	}
+	data, err := os.ReadFile(link)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Removes the link at link (in whichever form), if any
+func removeLink(link string) error {
+	for _, path := range []string{link, link + SHIM_EXT} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the path to execute to run the program link points to, completing
+// it with an extension from PATHEXT (e.g. "tool" for "tool.exe") as cmd.exe
+// would
+func linkExecutable(link string) string {
+	target, err := readLink(link)
+	if err != nil {
+		return link
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+	if _, err := os.Stat(target); err != nil {
+		if path, err := exec.LookPath(target); err == nil {
+			return path
+		}
+	}
+	return target
+}
+
+// Returns the name of the link stored in a links directory as fileName
+func linkName(fileName string) string {
+	return strings.TrimSuffix(fileName, SHIM_EXT)
+}
+
+// Reports whether path is a shim which invokes cachenv, e.g. one of our own
+// found in PATH
+func isShim(path string) bool {
+	if !strings.EqualFold(filepath.Ext(path), SHIM_EXT) {
+		return false
+	}
+	_, err := readLink(strings.TrimSuffix(path, filepath.Ext(path)))
+	return err == nil
+}
+
+// Reports whether the file described by info may be executed, which Windows
+// decides by its extension
+func isExecutable(path string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	pathExt := os.Getenv("PATHEXT")
+	if pathExt == "" {
+		pathExt = ".com;.exe;.bat;.cmd"
+	}
+	for _, ext := range filepath.SplitList(pathExt) {
+		if strings.EqualFold(filepath.Ext(path), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name cachenv was invoked as: "cachenv", or the name of a
+// memoized command whose shim ran it. The shim's variable is cleared, so the
+// command doesn't pass it on to another invocation of cachenv.
+func invokedName() string {
+	if name := os.Getenv(INVOKED_AS_VAR); name != "" {
+		os.Unsetenv(INVOKED_AS_VAR)
+		return name
+	}
+	name := filepath.Base(os.Args[0])
+	if strings.EqualFold(filepath.Ext(name), ".exe") {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Listing */
+
+// Prints a summary of every entry in the cache
+func handleList(args []string) int {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print entries as a JSON array")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv list [--json]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	keys, err := c.FS.Keys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	infos := make([]store.EntryInfo, 0, len(keys))
+	for _, key := range keys {
+		info, err := c.FS.Info(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+			return 1
+		}
+		infos = append(infos, info)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(infos); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding entries: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	for _, info := range infos {
+		created := info.Created
+		if created == "" {
+			created = "-"
+		}
+		duration := info.Duration
+		if duration == "" {
+			duration = "-"
+		}
+		fmt.Printf("%s  %-20s  %8s  %3d  %8d  %8d  %s\n", info.Hash, created, duration, info.ExitCode,
+			info.StdoutBytes, info.StderrBytes, info.CommandLine)
+	}
+	return 0
+}
+
+// Prints the hash of every entry, one per line, e.g. for piping into 'xargs
+// cachenv rm --yes --hash'. Unlike list, this reads no metadata, except to filter
+// by --command (skipping entries which don't record their command).
+func handleKeys(args []string) int {
+	flags := flag.NewFlagSet("keys", flag.ContinueOnError)
+	command := flags.String("command", "", "only print entries for this command")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv keys [--command <name>]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	keys, err := c.FS.Keys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	// Entries are recorded under the command an alias stands for
+	cmd := c.Config.Canonical(*command)
+	for _, key := range keys {
+		if cmd != "" {
+			if meta, err := c.FS.ReadMeta(key); err != nil || meta.Command != cmd {
+				continue
+			}
+		}
+		fmt.Println(key.Hash)
+	}
+	return 0
+}
+
+// Prints a summary of the entry for a single invocation, without its output.
+// Exits 1 if there is no such entry.
+func handleInfo(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv info <command> [arguments]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	stdin, err := c.StdinFor(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return 1
+	}
+
+	key, err := c.KeyFor(args[0], args[1:], stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
+		return 1
+	}
+	if !c.FS.Exists(key) {
+		fmt.Fprintf(os.Stderr, "No cached entry for this command+args (key %s).\n", key.Hash)
+		return 1
+	}
+
+	info, err := c.FS.Info(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+	created := info.Created
+	if created == "" {
+		created = "-"
+	}
+	fmt.Printf("hash:      %s\n", info.Hash)
+	fmt.Printf("path:      %s\n", c.FS.KeyDir(key))
+	fmt.Printf("command:   %s\n", info.CommandLine)
+	fmt.Printf("created:   %s\n", created)
+	if info.Duration != "" {
+		fmt.Printf("duration:  %s\n", info.Duration)
+	}
+	fmt.Printf("exit code: %d\n", info.ExitCode)
+	fmt.Printf("stdout:    %d bytes\n", info.StdoutBytes)
+	fmt.Printf("stderr:    %d bytes\n", info.StderrBytes)
+	return 0
+}
+
+// Plays back the cached output of an invocation, exiting with its cached exit
+// code, without ever running the real command. Exits 1 if there is no entry.
+func handleCat(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv cat <command> [arguments]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	stdin, err := c.StdinFor(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+		return 1
+	}
+
+	key, err := c.KeyFor(args[0], args[1:], stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing cache key: %v\n", err)
+		return 1
+	}
+	if !c.Store.Exists(key) {
+		fmt.Fprintf(os.Stderr, "No cached entry for this command+args (key %s).\n", key.Hash)
+		return 1
+	}
+
+	return c.replay(key)
+}
+
+// Writes the entry's cached output to stdout and stderr, returning its exit
+// code, or 1 if it can't be read
+func (c *Cachenv) replay(key store.CacheKey) int {
+	result, err := c.Store.ReadFromCache(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cached output: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(result.Stdout)
+	os.Stderr.Write(result.Stderr)
+	return result.ExitCode
+}
+
+// Like cat, but for the entry with the given hash (e.g. from 'cachenv list')
+func handleReplay(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv replay <hash>")
+		return 1
+	}
+	hash := args[0]
+	if !store.IsHex(hash) {
+		fmt.Fprintf(os.Stderr, "Invalid hash '%s'.\n", hash)
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	// Expand an abbreviated hash. One which matches no local entry is tried
+	// as is, e.g. in a remote cache.
+	key, err := c.FS.ResolvePrefix(hash)
+	if errors.Is(err, store.ErrNoEntry) {
+		key = store.CacheKey{Hash: hash}
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		return 1
+	}
+	if !c.Store.Exists(key) {
+		if _, err := os.Stat(c.FS.KeyDir(key)); err == nil {
+			fmt.Fprintf(os.Stderr, "Entry %s is incomplete (no status).\n", hash)
+		} else {
+			fmt.Fprintf(os.Stderr, "No cached entry %s.\n", hash)
+		}
+		return 1
+	}
+	return c.replay(key)
+}
+
+// Prints the invocation recorded for the entry with the given hash, or an
+// unambiguous prefix of it. Exits 1 if there's no such entry, or it doesn't
+// record its invocation.
+func handleResolve(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv resolve <hash>")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	key, err := c.FS.ResolvePrefix(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v.\n", err)
+		return 1
+	}
+	meta, err := c.FS.ReadMeta(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+	if meta.Command == "" {
+		fmt.Fprintf(os.Stderr, "Entry %s doesn't record its command.\n", key.Hash)
+		return 1
+	}
+	fmt.Println(meta.CommandLine())
+	return 0
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/* Diagnostics */
+
+// Suppresses informational messages, e.g. "Refreshed symlink for ls". Set by
+// CACHENV_QUIET or the --quiet flag. Errors and warnings are always printed.
+var quiet = envFlag("CACHENV_QUIET")
+
+// Prints an informational message to stderr, unless quiet
+func infof(format string, args ...any) {
+	if quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format, args...)
+}
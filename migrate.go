@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/* Migration */
+
+// Moves entries written by older versions into the current store layout
+func handleMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv migrate")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	moved, err := c.FS.Migrate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error migrating entries: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Migrated %d entries before the error; rerun to continue.\n", moved)
+		return 1
+	}
+	infof("Migrated %d entries.\n", moved)
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Output files */
+
+// A placeholder in an output_files template: {$N} for the Nth positional
+// argument, or {--flag} for the value of a flag
+var outputPlaceholder = regexp.MustCompile(`\{(\$[0-9]+|-[^}]+)\}`)
+
+// Returns the value of the argument named by a placeholder, if given
+func placeholderValue(name string, args []string) (string, bool) {
+	if _, ok := parsePosition(name); ok {
+		selected := selectArgs(args, []string{name})
+		if len(selected) == 0 {
+			return "", false
+		}
+		return strings.TrimPrefix(selected[0], name+"="), true
+	}
+	selected := selectArgs(args, []string{name + " VALUE"})
+	if len(selected) == 0 {
+		return "", false
+	}
+	_, value, ok := strings.Cut(selected[0], "=")
+	return value, ok
+}
+
+// Returns the paths the command's output_files templates name for an
+// invocation with args. Templates with a placeholder for an argument which
+// wasn't given are skipped.
+func outputFilePaths(cmdConfig store.CommandConfig, args []string) []string {
+	var paths []string
+	for _, template := range cmdConfig.OutputFiles {
+		missing := false
+		path := outputPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+			value, ok := placeholderValue(placeholder[1:len(placeholder)-1], args)
+			if !ok {
+				missing = true
+			}
+			return value
+		})
+		if !missing && path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Reads the files at paths, and every file under any which are directories.
+// Paths which don't exist are skipped: the command didn't write them.
+func captureOutputFiles(paths []string) ([]store.OutputFile, error) {
+	files := []store.OutputFile{}
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if path == root && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, store.OutputFile{Path: path, Mode: info.Mode().Perm(), Data: data})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to capture output files: %w", err)
+		}
+	}
+	return files, nil
+}
+
+// Reports whether path is one of paths or lies under one of them
+func withinAny(path string, paths []string) bool {
+	path = filepath.Clean(path)
+	for _, root := range paths {
+		root = filepath.Clean(root)
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes files back where the command wrote them, creating directories as
+// needed. Only files within paths, those the invocation's output_files name,
+// are written, so an entry (e.g. from a remote cache) can't write elsewhere.
+func restoreOutputFiles(files []store.OutputFile, paths []string) error {
+	for _, file := range files {
+		if !withinAny(file.Path, paths) {
+			return fmt.Errorf("cached output file '%s' isn't among output_files", file.Path)
+		}
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+			return fmt.Errorf("failed to restore '%s': %w", file.Path, err)
+		}
+		if err := writeFileAtomic(file.Path, file.Data, file.Mode); err != nil {
+			return fmt.Errorf("failed to restore '%s': %w", file.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+/* Processes */
+
+// Makes cmd start in its own process group, which is killed as a whole if
+// cmd's context is done
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// Sends sig to cmd, which has started, and to the rest of its process group
+// if it has its own. One sharing our process group has already received any
+// interrupt from the terminal itself.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		syscall.Kill(-cmd.Process.Pid, sig)
+	} else if sig != syscall.SIGINT {
+		cmd.Process.Signal(sig)
+	}
+}
+
+// Replaces this process with the program at path. Only returns on failure.
+func execReplacing(path string, argv []string) error {
+	return syscall.Exec(path, argv, os.Environ())
+}
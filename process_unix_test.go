@@ -0,0 +1,91 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+func TestTimeoutKillsProcessGroup(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{
+		"sh": {Timeout: 300 * time.Millisecond},
+	})
+
+	// The background sleep holds the output pipe open, so the command only
+	// finishes early if it's killed too
+	started := time.Now()
+	result, err := c.ExecuteRealCommand(ExecOptions{Timeout: 300 * time.Millisecond}, "sh", "-c", "sleep 5 & sleep 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TimedOut || result.ExitCode != TIMEOUT_EXIT_CODE {
+		t.Errorf("result = %+v, want a timeout", result)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("took %s, want about 300ms", elapsed)
+	}
+}
+
+func TestNoTimeoutSharesProcessGroup(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"sh": {}})
+
+	var stdout bytes.Buffer
+	result, err := c.ExecuteRealCommand(ExecOptions{Stdout: &stdout}, "sh", "-c", "ps -o pgid= -p $$")
+	if err != nil || result.ExitCode != 0 {
+		t.Skipf("ps failed: %v %+v", err, result)
+	}
+	pgid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	if err != nil {
+		t.Fatalf("unexpected ps output %q", stdout.String())
+	}
+	if pgid != syscall.Getpgrp() {
+		t.Errorf("command ran in process group %d, want ours (%d)", pgid, syscall.Getpgrp())
+	}
+}
+
+func TestSignalRelayed(t *testing.T) {
+	c := newTestCachenv(t, map[string]store.CommandConfig{"sh": {}})
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	go func() {
+		for {
+			if data, err := os.ReadFile(pidFile); err == nil && strings.HasSuffix(string(data), "\n") {
+				syscall.Kill(os.Getpid(), syscall.SIGTERM)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	started := time.Now()
+	result, err := c.ExecuteRealCommand(ExecOptions{}, "sh", "-c", `echo $$ > "$1"; exec sleep 5`, "sh", pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Interrupted || result.ExitCode != 128+int(syscall.SIGTERM) {
+		t.Errorf("result = %+v, want interrupted by SIGTERM", result)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("took %s; the signal wasn't relayed", elapsed)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Errorf("command %d outlived the signal", pid)
+	}
+}
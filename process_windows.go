@@ -0,0 +1,39 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+/* Processes */
+
+// Windows has no process groups to speak of: the command shares our console,
+// so it receives Ctrl-C itself, and cancellation kills just the command
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Kills cmd, which has started, unless sig is an interrupt, which the console
+// has already delivered to it
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if sig != syscall.SIGINT {
+		cmd.Process.Kill()
+	}
+}
+
+// Runs the program at path with our standard streams and exits with its exit
+// code, since Windows can't replace a process. Only returns on failure.
+func execReplacing(path string, argv []string) error {
+	cmd := exec.Command(path, argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+	}
+	os.Exit(exitCodeOf(cmd.ProcessState))
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Pruning */
+
+// Removes entries matching the provided criteria. With no criteria, trims
+// the cache to the configured max_entries.
+func handlePrune(args []string) int {
+	usage := "Usage: cachenv prune [--older-than <duration>] [--max <n>] [--older-version <version>] [--yes] [--dry-run]"
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", 0, "remove entries older than this (e.g. 24h)")
+	max := flags.Int("max", -1, "remove least recently used entries beyond this many")
+	olderVersion := flags.String("older-version", "", "remove entries written by a cachenv older than this version")
+	yes, dryRun := addRemoveFlags(flags)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	if *olderThan == 0 && *max < 0 && *olderVersion == "" {
+		if c.Config.Cache.MaxEntries <= 0 {
+			fmt.Fprintln(os.Stderr, "No max_entries configured; nothing to prune.")
+			fmt.Fprintln(os.Stderr, usage)
+			return 1
+		}
+		*max = c.Config.Cache.MaxEntries
+	}
+
+	// Apply each criterion in turn, each seeing only the entries which the
+	// ones before it left
+	var keys []store.CacheKey
+	selected := make(map[string]bool)
+	criteria := []func() ([]store.CacheKey, error){}
+	if *olderVersion != "" {
+		criteria = append(criteria, func() ([]store.CacheKey, error) {
+			return c.FS.KeysOlderThanVersion(*olderVersion)
+		})
+	}
+	if *olderThan > 0 {
+		criteria = append(criteria, func() ([]store.CacheKey, error) {
+			return c.FS.KeysOlderThan(*olderThan)
+		})
+	}
+	if *max >= 0 {
+		criteria = append(criteria, func() ([]store.CacheKey, error) {
+			return c.FS.KeysBeyondMax(*max, keys)
+		})
+	}
+
+	for _, criterion := range criteria {
+		matching, err := criterion()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+			return 1
+		}
+		for _, key := range matching {
+			if !selected[key.Hash] {
+				selected[key.Hash] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return c.removeEntries(keys, *yes, *dryRun)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+/* Output redaction */
+
+// Substituted for redacted matches unless redact_replacement is set
+const DEFAULT_REDACT_REPLACEMENT = "[REDACTED]"
+
+// Matches ANSI escape sequences: CSI sequences such as colors and cursor
+// movement, OSC sequences such as hyperlinks and window titles, and other
+// two-character escapes
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// Removes a command's ANSI escape sequences (if strip_ansi is set) and
+// replaces matches of its redact patterns in its output
+type Redactor struct {
+	stripANSI   bool
+	patterns    []*regexp.Regexp
+	replacement []byte
+}
+
+// Returns the redactor for cmd, or nil if its output isn't to be altered
+func (c *Cachenv) RedactorFor(cmd string) (*Redactor, error) {
+	cmdConfig := c.Config.Commands[cmd]
+	if len(cmdConfig.Redact) == 0 && !cmdConfig.StripANSI {
+		return nil, nil
+	}
+	r := &Redactor{
+		stripANSI:   cmdConfig.StripANSI,
+		replacement: []byte(DEFAULT_REDACT_REPLACEMENT),
+	}
+	if cmdConfig.RedactReplacement != "" {
+		r.replacement = []byte(cmdConfig.RedactReplacement)
+	}
+	for _, pattern := range cmdConfig.Redact {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern for '%s': %w", cmd, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Returns data with escape sequences removed and every match replaced. The
+// replacement may refer to submatches, as in regexp.Regexp.Expand (e.g.
+// "$1=[REDACTED]").
+func (r *Redactor) Redact(data []byte) []byte {
+	if r.stripANSI {
+		data = ansiPattern.ReplaceAll(data, nil)
+	}
+	for _, re := range r.patterns {
+		data = re.ReplaceAll(data, r.replacement)
+	}
+	return data
+}
+
+// Returns the length of the escape sequence at the start of data, which
+// begins with ESC, as ansiPattern would match it, or -1 if more data is
+// needed to tell
+func escapeLen(data []byte) int {
+	if len(data) < 2 {
+		return -1
+	}
+	switch data[1] {
+	case '[':
+		i := 2
+		for i < len(data) && data[i] >= '0' && data[i] <= '?' {
+			i++
+		}
+		for i < len(data) && data[i] >= ' ' && data[i] <= '/' {
+			i++
+		}
+		if i == len(data) {
+			return -1
+		}
+		if data[i] >= '@' && data[i] <= '~' {
+			return i + 1
+		}
+	case ']':
+		for i := 2; i < len(data); i++ {
+			switch {
+			case data[i] == '\x07':
+				return i + 1
+			case data[i] == '\x1b' && i+1 == len(data):
+				return -1
+			case data[i] == '\x1b' && data[i+1] == '\\':
+				return i + 2
+			case data[i] == '\x1b':
+				// Not terminated, so only the ESC ] is a sequence
+				return 2
+			}
+		}
+		return -1
+	}
+	if data[1] >= '@' && data[1] <= '_' && data[1] != '[' {
+		return 2
+	}
+	// Not a sequence at all
+	return 1
+}
+
+// Returns the length of the longest prefix of data which doesn't end within
+// an escape sequence
+func completeEscapes(data []byte) int {
+	for i := 0; i < len(data); {
+		start := bytes.IndexByte(data[i:], '\x1b')
+		if start < 0 {
+			break
+		}
+		start += i
+		n := escapeLen(data[start:])
+		if n < 0 {
+			return start
+		}
+		i = start + n
+	}
+	return len(data)
+}
+
+// Redacts output before writing it to w, so that the same bytes are shown and
+// cached however the output is chunked. With redact patterns, output is
+// redacted line by line, so patterns can't match across lines, and a partial
+// line is held until its newline. Otherwise, only an unfinished escape
+// sequence is held. Flush must be called once the command exits, to write
+// whatever is held.
+type redactingWriter struct {
+	w        io.Writer
+	redactor *Redactor
+	pending  []byte
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	rw.pending = append(rw.pending, p...)
+	var end int
+	if len(rw.redactor.patterns) > 0 {
+		end = bytes.LastIndexByte(rw.pending, '\n') + 1
+	} else {
+		end = completeEscapes(rw.pending)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+	var redacted []byte
+	if len(rw.redactor.patterns) > 0 {
+		for _, line := range bytes.SplitAfter(rw.pending[:end], []byte("\n")) {
+			redacted = append(redacted, rw.redactor.Redact(line)...)
+		}
+	} else {
+		redacted = rw.redactor.Redact(rw.pending[:end])
+	}
+	rw.pending = append(rw.pending[:0], rw.pending[end:]...)
+	if _, err := rw.w.Write(redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (rw *redactingWriter) Flush() error {
+	if len(rw.pending) == 0 {
+		return nil
+	}
+	_, err := rw.w.Write(rw.redactor.Redact(rw.pending))
+	rw.pending = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+// Writes data through a redactingWriter in chunks of size n, returning what
+// reached the underlying writer before and after Flush
+func redactInChunks(r *Redactor, data string, n int) (string, string) {
+	var out bytes.Buffer
+	rw := &redactingWriter{w: &out, redactor: r}
+	for i := 0; i < len(data); i += n {
+		end := i + n
+		if end > len(data) {
+			end = len(data)
+		}
+		rw.Write([]byte(data[i:end]))
+	}
+	before := out.String()
+	rw.Flush()
+	return before, out.String()
+}
+
+func TestRedactingWriterChunking(t *testing.T) {
+	inputs := []string{
+		"\x1b[31mred\x1b[0m plain\n",
+		"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\ and \x1b]0;title\x07done",
+		"token=abc123 \x1b[1mbold\x1b[0m\ntoken=def456",
+		"\x1b[31", // unfinished at exit
+	}
+	redactors := []*Redactor{
+		{stripANSI: true},
+		{stripANSI: true, patterns: []*regexp.Regexp{regexp.MustCompile(`token=\w+`)}, replacement: []byte("[REDACTED]")},
+	}
+	for _, r := range redactors {
+		for _, input := range inputs {
+			_, expected := redactInChunks(r, input, len(input))
+			for n := 1; n < len(input); n++ {
+				if _, actual := redactInChunks(r, input, n); actual != expected {
+					t.Errorf("%q in chunks of %d: got %q, want %q", input, n, actual, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestRedactingWriterStreamsPartialLines(t *testing.T) {
+	// Without patterns, a prompt shows before its line ends
+	before, _ := redactInChunks(&Redactor{stripANSI: true}, "\x1b[1mPassword:\x1b[0m ", 4)
+	if before != "Password: " {
+		t.Errorf("before flush: got %q, want %q", before, "Password: ")
+	}
+
+	// An unfinished escape sequence is held
+	before, after := redactInChunks(&Redactor{stripANSI: true}, "ok \x1b[3", 1)
+	if before != "ok " || after != "ok \x1b[3" {
+		t.Errorf("got %q then %q", before, after)
+	}
+
+	// With patterns, lines are held until complete
+	r := &Redactor{patterns: []*regexp.Regexp{regexp.MustCompile(`secret`)}, replacement: []byte("***")}
+	before, after = redactInChunks(r, "a secret\nthe secret", 3)
+	if before != "a ***\n" || after != "a ***\nthe ***" {
+		t.Errorf("got %q then %q", before, after)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Disk usage reporting */
+
+type CommandSize struct {
+	Command string `json:"command"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// The commands' and entries' sizes count outputs they share with others in
+// full, while the totals count each file once
+type SizeReport struct {
+	TotalBytes        int64             `json:"total_bytes"`
+	BlobBytes         int64             `json:"blob_bytes"`
+	UnreferencedBytes int64             `json:"unreferenced_bytes"`
+	Commands          []CommandSize     `json:"commands,omitempty"`
+	Entries           []store.EntrySize `json:"entries,omitempty"`
+}
+
+// Sums entry sizes per command, largest first
+func commandSizes(entries []store.EntrySize) []CommandSize {
+	byCommand := make(map[string]*CommandSize)
+	for _, entry := range entries {
+		cs, ok := byCommand[entry.Command]
+		if !ok {
+			cs = &CommandSize{Command: entry.Command}
+			byCommand[entry.Command] = cs
+		}
+		cs.Entries++
+		cs.Bytes += entry.Bytes
+	}
+
+	sizes := make([]CommandSize, 0, len(byCommand))
+	for _, cs := range byCommand {
+		sizes = append(sizes, *cs)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Bytes != sizes[j].Bytes {
+			return sizes[i].Bytes > sizes[j].Bytes
+		}
+		return sizes[i].Command < sizes[j].Command
+	})
+	return sizes
+}
+
+// Formats a byte count, optionally in human-readable units (K, M, G, ...)
+func formatBytes(n int64, human bool) string {
+	if !human {
+		return fmt.Sprint(n)
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Reports total cache size, size per command, and the largest entries. Also
+// available as 'cachenv du'. The total counts outputs shared between entries
+// once; sizes per command and entry count them in each.
+func handleSize(args []string) int {
+	flags := flag.NewFlagSet("size", flag.ContinueOnError)
+	by := flags.String("by", "", "only report sizes by 'command' or 'entry'")
+	human := flags.Bool("h", false, "print sizes in human-readable units")
+	flags.BoolVar(human, "human", false, "same as -h")
+	top := flags.Int("n", 10, "number of largest entries to report")
+	flags.IntVar(top, "top", 10, "same as -n")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv size|du [--by command|entry] [-h|--human] [-n|--top N] [--json]")
+		return 1
+	}
+	if *by != "" && *by != "command" && *by != "entry" {
+		fmt.Fprintf(os.Stderr, "Invalid value for --by: '%s' (expected 'command' or 'entry')\n", *by)
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	entries, err := c.FS.EntrySizes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	usage, err := c.FS.DiskUsage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	report := SizeReport{
+		TotalBytes:        usage.Bytes,
+		BlobBytes:         usage.BlobBytes,
+		UnreferencedBytes: usage.UnreferencedBytes,
+	}
+	if *by == "" || *by == "command" {
+		report.Commands = commandSizes(entries)
+	}
+	if *by == "" || *by == "entry" {
+		if *top >= 0 && len(entries) > *top {
+			entries = entries[:*top]
+		}
+		report.Entries = entries
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding report: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Printf("Total: %s\n", formatBytes(report.TotalBytes, *human))
+	fmt.Printf("Blobs: %s", formatBytes(report.BlobBytes, *human))
+	if report.UnreferencedBytes > 0 {
+		fmt.Printf(" (%s unreferenced; run 'cachenv gc')", formatBytes(report.UnreferencedBytes, *human))
+	}
+	fmt.Println()
+	if report.Commands != nil {
+		fmt.Println("\nBy command:")
+		for _, cs := range report.Commands {
+			fmt.Printf("%10s  %5d  %s\n", formatBytes(cs.Bytes, *human), cs.Entries, cs.Command)
+		}
+	}
+	if report.Entries != nil {
+		fmt.Println("\nLargest entries:")
+		for _, entry := range report.Entries {
+			fmt.Printf("%10s  %s  %s\n", formatBytes(entry.Bytes, *human), entry.Hash, entry.CommandLine)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+// Writes an entry of exactly size bytes for an invocation of command directly
+// into the store
+func seedEntry(t *testing.T, c *Cachenv, hash, command string, size int) {
+	t.Helper()
+	dir := c.FS.KeyDir(store.CacheKey{Hash: hash})
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	meta := "command: " + command + "\nargs: []\n"
+	files := map[string]string{
+		"meta":   meta,
+		"status": "0",
+		"err":    "",
+		"out":    strings.Repeat("x", size-len(meta)-1),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSizeReport(t *testing.T) {
+	c := newTestCachenv(t, nil)
+	dirFlag = c.Dir
+	t.Cleanup(func() { dirFlag = "" })
+	seedEntry(t, c, "aaaa", "ls", 100)
+	seedEntry(t, c, "bbbb", "curl", 5000)
+	seedEntry(t, c, "cccc", "ls", 300)
+
+	var code int
+	out := captureStdout(t, func() { code = handleSize([]string{"--json", "-n", "2"}) })
+	if code != 0 {
+		t.Fatalf("size exited %d", code)
+	}
+	var report SizeReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("decoding %q: %v", out, err)
+	}
+
+	if report.TotalBytes != 5400 {
+		t.Errorf("total = %d, want 5400", report.TotalBytes)
+	}
+	expectedCommands := []CommandSize{{"curl", 1, 5000}, {"ls", 2, 400}}
+	if len(report.Commands) != len(expectedCommands) {
+		t.Fatalf("commands = %+v, want %+v", report.Commands, expectedCommands)
+	}
+	for i, cs := range expectedCommands {
+		if report.Commands[i] != cs {
+			t.Errorf("commands[%d] = %+v, want %+v", i, report.Commands[i], cs)
+		}
+	}
+	if len(report.Entries) != 2 || report.Entries[0].Hash != "bbbb" || report.Entries[1].Hash != "cccc" {
+		t.Errorf("largest entries = %+v, want bbbb then cccc", report.Entries)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, expected := range map[int64]string{512: "512B", 1536: "1.5K", 3 << 20: "3.0M"} {
+		if actual := formatBytes(n, true); actual != expected {
+			t.Errorf("formatBytes(%d) = %s, want %s", n, actual, expected)
+		}
+	}
+	if actual := formatBytes(1536, false); actual != "1536" {
+		t.Errorf("formatBytes(1536, false) = %s", actual)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/* Hit/miss statistics */
+
+// Prints entry counts, size, and hit/miss statistics for the cache
+func handleStats(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv stats")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	usage, err := c.FS.DiskUsage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	stats, err := c.FS.ReadStats()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading stats: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Entries:  %d\n", usage.Entries)
+	fmt.Printf("Size:     %s\n", formatBytes(usage.Bytes, true))
+	fmt.Printf("Hits:     %d\n", stats.Hits)
+	fmt.Printf("Misses:   %d\n", stats.Misses)
+	fmt.Printf("Hit rate: %.1f%%\n", stats.HitRate())
+	return 0
+}
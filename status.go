@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/* Environment overview */
+
+// Prints the active cachenv's directory, memoized commands, cache size, and
+// the health of its symlinks. Exits 1 if no cachenv is active.
+func handleStatus(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv status")
+		return 1
+	}
+
+	if _, err := getActiveCachenvDir(); err != nil {
+		fmt.Fprintln(os.Stderr, "No cachenv is activated.")
+		return 1
+	}
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	commands := make([]string, 0, len(c.Config.Commands))
+	for cmd := range c.Config.Commands {
+		commands = append(commands, cmd)
+	}
+	sort.Strings(commands)
+
+	usage, err := c.FS.DiskUsage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading cache: %v\n", err)
+		return 1
+	}
+
+	problems, err := c.auditLinks()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking symlinks: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Active:   %s\n", c.Dir)
+	if len(commands) == 0 {
+		fmt.Println("Commands: (none)")
+	} else {
+		fmt.Printf("Commands: %s\n", strings.Join(commands, " "))
+	}
+	fmt.Printf("Entries:  %d\n", usage.Entries)
+	fmt.Printf("Size:     %s\n", formatBytes(usage.Bytes, true))
+	if len(problems) == 0 {
+		fmt.Println("Links:    ok")
+	} else {
+		fmt.Printf("Links:    %d problems (run 'cachenv doctor' for details)\n", len(problems))
+	}
+	return 0
+}
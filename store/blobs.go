@@ -0,0 +1,197 @@
+package store
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* Content-addressed output storage */
+
+// Name of the directory in FSStore.Dir holding output blobs, which entries'
+// out/err files are hardlinks to. Identical outputs are stored once.
+const BLOBS_NAME = "blobs"
+
+func (s *FSStore) blobsDir() string {
+	return filepath.Join(s.Dir, BLOBS_NAME)
+}
+
+// Writes data to path as a hardlink to the blob with the same content,
+// creating the blob if needed. Falls back to writing a plain copy where
+// hardlinks aren't possible (e.g. the filesystem lacks them, or the blob has
+// too many links). Returns the number of bytes this added on disk: none if
+// the blob already existed.
+func (s *FSStore) writeBlobLink(path string, data []byte) (int64, error) {
+	created, err := s.linkBlob(path, data)
+	if err == nil {
+		return created, nil
+	}
+	if err := os.WriteFile(path, data, s.FileMode()); err != nil {
+		return created, err
+	}
+	return created + int64(len(data)), nil
+}
+
+// Links path to the blob for data, returning the number of bytes written to
+// create the blob, if it didn't exist
+func (s *FSStore) linkBlob(path string, data []byte) (int64, error) {
+	var created int64
+	blob := filepath.Join(s.blobsDir(), fmt.Sprintf("%x", sha256.Sum256(data)))
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(s.blobsDir(), s.DirMode()); err != nil {
+			return 0, err
+		}
+		f, err := os.CreateTemp(s.blobsDir(), STAGING_PREFIX)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return 0, err
+		}
+		if err := f.Chmod(s.FileMode()); err != nil {
+			f.Close()
+			return 0, err
+		}
+		if err := f.Close(); err != nil {
+			return 0, err
+		}
+		if err := os.Rename(f.Name(), blob); err != nil {
+			return 0, err
+		}
+		created = int64(len(data))
+	} else if s.Private {
+		// The blob may be shared with entries written before private was
+		// set, and links share its mode
+		if err := os.Chmod(blob, s.FileMode()); err != nil {
+			return 0, err
+		}
+	}
+	// Fails if the blob was just collected, in which case the caller writes
+	// a copy instead
+	return created, os.Link(blob, path)
+}
+
+// Returns the path of the blob which the entry file at path links to, if any
+func (s *FSStore) blobOf(path string, info os.FileInfo) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	blob := filepath.Join(s.blobsDir(), fmt.Sprintf("%x", sha256.Sum256(data)))
+	blobInfo, err := os.Stat(blob)
+	if err != nil || !os.SameFile(info, blobInfo) {
+		return "", false
+	}
+	return blob, true
+}
+
+// Removes dir (an entry's directory) along with the blobs which only it
+// linked to, returning the number of bytes this freed on disk. The caller
+// holds the store lock. A blob linked again meanwhile is harmless to remove:
+// the new link keeps its data, and a write racing with us falls back to a
+// copy.
+func (s *FSStore) removeFreeing(dir string) (int64, error) {
+	var freed int64
+	var blobs []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if links, ok := linkCount(path, info); ok && links > 1 {
+			if blob, ok := s.blobOf(path, info); ok {
+				blobs = append(blobs, blob)
+			}
+			return nil
+		}
+		freed += info.Size()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+
+	for _, blob := range blobs {
+		info, err := os.Stat(blob)
+		if err != nil {
+			continue
+		}
+		if links, ok := linkCount(blob, info); !ok || links > 1 {
+			continue
+		}
+		if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+			return freed, fmt.Errorf("failed to remove blob %s: %w", filepath.Base(blob), err)
+		}
+		freed += info.Size()
+	}
+	return freed, nil
+}
+
+// Removes staging directories (and staged blobs) left behind by interrupted
+// writes, returning how many were removed. These would otherwise keep the
+// blobs they link to from being collected.
+func (s *FSStore) GCStaging() (int, error) {
+	removed := 0
+	for _, dir := range []string{s.Dir, s.blobsDir()} {
+		names, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, fmt.Errorf("failed to read %s: %w", dir, err)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name.Name(), STAGING_PREFIX) {
+				continue
+			}
+			info, err := name.Info()
+			if err != nil || time.Since(info.ModTime()) < STAGING_MAX_AGE {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, name.Name())); err != nil {
+				return removed, fmt.Errorf("failed to remove %s: %w", name.Name(), err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Removes blobs which no entry links to, returning how many were removed.
+// Removing entries frees their blobs already, so this only finds blobs left by
+// entries removed other ways, e.g. by hand or by older versions.
+func (s *FSStore) GCBlobs() (int, error) {
+	blobs, err := os.ReadDir(s.blobsDir())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read blobs directory: %w", err)
+	}
+
+	removed := 0
+	for _, blob := range blobs {
+		info, err := blob.Info()
+		if err != nil {
+			return removed, err
+		}
+		path := filepath.Join(s.blobsDir(), blob.Name())
+		if links, ok := linkCount(path, info); !ok || links > 1 {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove blob %s: %w", blob.Name(), err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func blobExists(s *FSStore, data string) bool {
+	_, err := os.Stat(filepath.Join(s.blobsDir(), fmt.Sprintf("%x", sha256.Sum256([]byte(data)))))
+	return err == nil
+}
+
+func TestRemoveFreesUnsharedBlobs(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	a, b := testKey("a"), testKey("b")
+	shared := "shared output"
+	for _, key := range []CacheKey{a, b} {
+		if err := s.WriteToCache(key, ExecResult{Stdout: []byte(shared)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Still used by b
+	if _, err := s.RemoveFreeing(a); err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(s, shared) {
+		t.Fatal("removing one entry freed a blob another still uses")
+	}
+	if result, err := s.ReadFromCache(b); err != nil || string(result.Stdout) != shared {
+		t.Fatalf("remaining entry = %q, %v", result.Stdout, err)
+	}
+
+	freed, err := s.RemoveFreeing(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobExists(s, shared) {
+		t.Error("removing the last entry using a blob didn't free it")
+	}
+	if freed < int64(len(shared)) {
+		t.Errorf("freed %d bytes, want at least %d", freed, len(shared))
+	}
+}
+
+func TestEvictionAndRewriteFreeBlobs(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir(), MaxEntries: 1}
+	a, b := testKey("a"), testKey("b")
+	if err := s.WriteToCache(a, ExecResult{Stdout: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteToCache(a, ExecResult{Stdout: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists(s, "first") {
+		t.Error("rewriting an entry didn't free its old output")
+	}
+
+	if err := s.WriteToCache(b, ExecResult{Stdout: []byte("third")}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(a) || blobExists(s, "second") {
+		t.Error("evicting an entry didn't free its output")
+	}
+	if !blobExists(s, "third") {
+		t.Error("the remaining entry's output was freed")
+	}
+}
+
+func TestDiskUsageCountsSharedOutputsOnce(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	shared := strings.Repeat("x", 1000)
+	a, b := testKey("a"), testKey("b")
+	for _, key := range []CacheKey{a, b} {
+		if err := s.WriteToCache(key, ExecResult{Stdout: []byte(shared)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An orphaned blob, as left by an entry deleted by hand
+	orphan := strings.Repeat("y", 500)
+	removed := filepath.Join(t.TempDir(), "out")
+	if _, err := s.linkBlob(removed, []byte(orphan)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	sizeA, err := s.EntrySize(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := s.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Entries != 2 {
+		t.Errorf("entries = %d, want 2", usage.Entries)
+	}
+	// Each entry has a status file of its own besides the shared output
+	if expected := sizeA + 1 + int64(len(orphan)); usage.Bytes != expected {
+		t.Errorf("bytes = %d, want %d", usage.Bytes, expected)
+	}
+	if expected := int64(len(shared) + len(orphan)); usage.BlobBytes != expected {
+		t.Errorf("blob bytes = %d, want %d", usage.BlobBytes, expected)
+	}
+	if usage.UnreferencedBytes != int64(len(orphan)) {
+		t.Errorf("unreferenced bytes = %d, want %d", usage.UnreferencedBytes, len(orphan))
+	}
+}
+
+func TestFreedBy(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	shared := strings.Repeat("x", 1000)
+	a, b := testKey("a"), testKey("b")
+	for _, key := range []CacheKey{a, b} {
+		if err := s.WriteToCache(key, ExecResult{Stdout: []byte(shared)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only a's status file is its own; the output is shared with b
+	if freed, err := s.FreedBy([]CacheKey{a}); err != nil || freed != 1 {
+		t.Errorf("FreedBy(a) = %d, %v; want 1", freed, err)
+	}
+	both, err := s.FreedBy([]CacheKey{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := int64(len(shared) + 2); both != expected {
+		t.Errorf("FreedBy(a, b) = %d, want %d", both, expected)
+	}
+
+	var freed int64
+	for _, key := range []CacheKey{a, b} {
+		n, err := s.RemoveFreeing(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		freed += n
+	}
+	if freed != both {
+		t.Errorf("removing both freed %d bytes, FreedBy predicted %d", freed, both)
+	}
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+/* Compression */
+
+// Extension of compressed stdout/stderr files
+const GZIP_EXT = ".gz"
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the path at which an output file is actually stored: the plain path
+// if it exists, otherwise its compressed form if that exists, otherwise the
+// plain path.
+func ResolveOutputPath(path string) string {
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if _, err := os.Stat(path + GZIP_EXT); err == nil {
+		return path + GZIP_EXT
+	}
+	return path
+}
+
+// Reads an output file, decompressing it if it was stored compressed
+func readOutput(path string) ([]byte, error) {
+	resolved := ResolveOutputPath(path)
+	if resolved == path {
+		return os.ReadFile(path)
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Returns the path of a plain file containing the entry's stdout. For
+// compressed entries this is a decompressed temporary copy, which the
+// returned function removes.
+func (s *FSStore) StdoutFile(key CacheKey) (string, func(), error) {
+	path := s.stdoutPath(key)
+	if ResolveOutputPath(path) == path {
+		return path, func() {}, nil
+	}
+
+	stdout, err := readOutput(path)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.CreateTemp("", "cachenv-out-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	cleanup := func() { os.Remove(f.Name()) }
+	if _, err := f.Write(stdout); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return f.Name(), cleanup, nil
+}
@@ -0,0 +1,575 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* Config */
+
+type CommandConfig struct {
+	// Absolute path of the executable to run, for commands added by path
+	// (e.g. ones not on PATH). Unset means the command is looked up in PATH.
+	Path string `yaml:"path,omitempty"`
+
+	// How long entries remain valid, e.g. "5m". Zero means forever.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// How long failures (non-zero exits) remain valid, e.g. so that a flaky
+	// service isn't hammered. Unset or zero means failures aren't cached at
+	// all; a command may set zero to override a default.
+	FailureTTL *time.Duration `yaml:"failure_ttl,omitempty"`
+
+	// How long the real command may run before it's killed, e.g. "30s".
+	// Results of commands which time out aren't cached. Zero means no limit.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Whether output depends on the working directory, which is then
+	// included in the cache key
+	CwdSensitive bool `yaml:"cwd_sensitive,omitempty"`
+
+	// Whether output depends on stdin, which is then read in full (when it's
+	// piped or redirected) and included in the cache key. Otherwise stdin is
+	// left to the command, so that e.g. one run in a 'while read' loop doesn't
+	// consume the loop's input.
+	Stdin bool `yaml:"stdin,omitempty"`
+
+	// Flags which don't affect output, and so are ignored when computing the
+	// cache key, e.g. "--color". Write flags whose value is a separate
+	// argument with a placeholder, e.g. "--log-file FILE".
+	IgnoreArgs []string `yaml:"ignore_args,omitempty"`
+
+	// Arguments which are passed to the command but, varying between
+	// invocations without affecting the output (e.g. "--request-id"), are
+	// left out of the cache key. Flags are left out along with their value;
+	// other patterns are globs matching positional arguments.
+	VolatileArgs []string `yaml:"volatile_args,omitempty"`
+
+	// If set, the only arguments included in the cache key: flags as in
+	// IgnoreArgs, or "$N" for the Nth positional argument. Can't be combined
+	// with IgnoreArgs or VolatileArgs.
+	KeyArgs []string `yaml:"key_args,omitempty"`
+
+	// Flags which make an invocation skip the cache and run the real
+	// command, e.g. "--refresh". They're left out of the cache key, and are
+	// passed on to the command unless they're also ignore_args.
+	BypassIfArgs []string `yaml:"bypass_if_args,omitempty"`
+
+	// Whether the result of an invocation bypassing the cache replaces the
+	// cached entry, as with CACHENV_REFRESH. Unset leaves the entry as is.
+	BypassRefreshes bool `yaml:"bypass_refreshes,omitempty"`
+
+	// Arguments used when the command is invoked without any, so that e.g.
+	// "terraform" runs, and shares an entry with, "terraform providers"
+	DefaultArgs []string `yaml:"default_args,omitempty"`
+
+	// Which results are cached, by exit code (default: all). Failures are
+	// only cached if FailureTTL is also set.
+	CacheOn CachePolicy `yaml:"cache_on,omitempty"`
+
+	// Overrides cache.max_output_bytes for this command
+	MaxOutputBytes int64 `yaml:"max_output_bytes,omitempty"`
+
+	// Regular expressions whose matches in the output (e.g. tokens or
+	// timestamps) are replaced before it's shown or cached. Matched line by
+	// line.
+	Redact []string `yaml:"redact,omitempty"`
+
+	// What matches of Redact are replaced with (default: "[REDACTED]")
+	RedactReplacement string `yaml:"redact_replacement,omitempty"`
+
+	// Whether to include the command's executable in the cache key, so that
+	// upgrading it invalidates its entries
+	KeyBinary BinaryFingerprint `yaml:"key_binary,omitempty"`
+
+	// Files or directories the command writes, which are cached along with
+	// its output and restored on hits, e.g. "{--cpp_out}" or "out/{$1}.txt".
+	// {$N} stands for the Nth positional argument and {--flag} for the value
+	// of a flag; paths naming an argument which wasn't given are skipped.
+	OutputFiles []string `yaml:"output_files,omitempty"`
+
+	// Glob patterns (relative to the working directory) of files the command
+	// reads, whose contents are included in the cache key
+	WatchFiles []string `yaml:"watch_files,omitempty"`
+
+	// Whether to include the contents of any arguments naming existing files
+	// in the cache key, as if they were listed in WatchFiles
+	WatchArgs bool `yaml:"watch_args,omitempty"`
+
+	// Whether to run the command uncached when its stdout is a terminal, as
+	// when it's used interactively (e.g. with a pager or prompts)
+	SkipIfTTY bool `yaml:"skip_if_tty,omitempty"`
+
+	// Whether hits take as long as the command originally did, for
+	// reproducing timing-sensitive behavior (e.g. in tests)
+	ReplayDelay bool `yaml:"replay_delay,omitempty"`
+
+	// Whether to remove ANSI escape sequences (e.g. colors) from the output
+	StripANSI bool `yaml:"strip_ansi,omitempty"`
+
+	// Whether to ask the command for colored output even though its output
+	// is a pipe, by setting CLICOLOR_FORCE and FORCE_COLOR
+	ForceColor bool `yaml:"force_color,omitempty"`
+
+	// The options given in the config, even if to their zero value (e.g.
+	// "skip_if_tty: false"), so that they override defaults and are written
+	// back. Nil for configs not read from YAML.
+	set map[string]bool
+}
+
+// Returns the name of the option for the struct field, as in the config
+func yamlKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
+
+// CommandConfig without its own UnmarshalYAML, for decoding it as usual
+type commandConfig CommandConfig
+
+func (c *CommandConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal((*commandConfig)(c)); err != nil {
+		return err
+	}
+	var options map[string]interface{}
+	if err := unmarshal(&options); err != nil {
+		return err
+	}
+	c.set = make(map[string]bool, len(options))
+	for key := range options {
+		c.set[key] = true
+	}
+	return nil
+}
+
+// Writes the options which are set, including those explicitly set to their
+// zero value
+func (c CommandConfig) MarshalYAML() (interface{}, error) {
+	var options yaml.MapSlice
+	value := reflect.ValueOf(c)
+	for i := 0; i < value.NumField(); i++ {
+		key := yamlKey(value.Type().Field(i))
+		if key == "" || key == "-" {
+			continue
+		}
+		if field := value.Field(i); !field.IsZero() || c.set[key] {
+			options = append(options, yaml.MapItem{Key: key, Value: field.Interface()})
+		}
+	}
+	return options, nil
+}
+
+// Reports whether the two configs have the same options, however they were
+// given
+func (c CommandConfig) Equal(other CommandConfig) bool {
+	c.set, other.set = nil, nil
+	return reflect.DeepEqual(c, other)
+}
+
+// Returns the command's config with every option it leaves unset taken from
+// defaults. An option given in the config counts as set even if it's zero
+// (e.g. "skip_if_tty: false"), turning off what defaults turn on. Path is
+// never inherited, and neither are argument options which would conflict
+// with the command's own (key_args, or ignore_args and volatile_args).
+func (c CommandConfig) WithDefaults(defaults CommandConfig) CommandConfig {
+	defaults.Path = ""
+	if c.KeyArgs != nil || c.set["key_args"] {
+		defaults.IgnoreArgs, defaults.VolatileArgs = nil, nil
+	} else if c.IgnoreArgs != nil || c.VolatileArgs != nil || c.set["ignore_args"] || c.set["volatile_args"] {
+		defaults.KeyArgs = nil
+	}
+
+	resolved := reflect.ValueOf(&c).Elem()
+	fallback := reflect.ValueOf(defaults)
+	for i := 0; i < resolved.NumField(); i++ {
+		key := yamlKey(resolved.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		if field := resolved.Field(i); field.IsZero() && !c.set[key] {
+			field.Set(fallback.Field(i))
+		}
+	}
+	return c
+}
+
+// Which exit codes are cached: "always" (the default), "success" (exit code 0
+// only), or an explicit list of exit codes
+type CachePolicy struct {
+	Name      string `yaml:"-"`
+	ExitCodes []int  `yaml:"-"`
+}
+
+func (p *CachePolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		switch name {
+		case "always":
+			*p = CachePolicy{Name: name}
+		case "success":
+			*p = CachePolicy{Name: name, ExitCodes: []int{0}}
+		default:
+			return fmt.Errorf("invalid cache_on '%s' (expected 'always', 'success', or a list of exit codes)", name)
+		}
+		return nil
+	}
+
+	var exitCodes []int
+	if err := unmarshal(&exitCodes); err != nil {
+		return fmt.Errorf("invalid cache_on (expected 'always', 'success', or a list of exit codes)")
+	}
+	*p = CachePolicy{ExitCodes: exitCodes}
+	return nil
+}
+
+func (p CachePolicy) MarshalYAML() (interface{}, error) {
+	if p.Name != "" {
+		return p.Name, nil
+	}
+	return p.ExitCodes, nil
+}
+
+// Reports whether a result with exitCode should be cached
+func (p CachePolicy) Allows(exitCode int) bool {
+	if p.ExitCodes == nil {
+		return true
+	}
+	for _, code := range p.ExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a result with exitCode should be cached
+func (c CommandConfig) Caches(exitCode int) bool {
+	return c.CacheOn.Allows(exitCode) && (exitCode == 0 || c.cachesFailures())
+}
+
+func (c CommandConfig) cachesFailures() bool {
+	return c.FailureTTL != nil && *c.FailureTTL > 0
+}
+
+// Returns how long an entry with exitCode remains valid. Zero means forever.
+func (c CommandConfig) TTLFor(exitCode int) time.Duration {
+	if exitCode != 0 && c.cachesFailures() {
+		return *c.FailureTTL
+	}
+	return c.TTL
+}
+
+// Returns how long any entry remains valid, whatever its exit code
+func (c CommandConfig) MaxTTL() time.Duration {
+	if !c.cachesFailures() || c.TTL == 0 || *c.FailureTTL < c.TTL {
+		return c.TTL
+	}
+	return *c.FailureTTL
+}
+
+// How a command's executable is identified in the cache key: not at all (the
+// default), by "mtime" (its path, size and modification time; true is an
+// alias), or by "content" (a hash of the whole file, which is read on every
+// invocation)
+type BinaryFingerprint string
+
+const (
+	BINARY_FINGERPRINT_MTIME   BinaryFingerprint = "mtime"
+	BINARY_FINGERPRINT_CONTENT BinaryFingerprint = "content"
+)
+
+func (f *BinaryFingerprint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*f = ""
+		if enabled {
+			*f = BINARY_FINGERPRINT_MTIME
+		}
+		return nil
+	}
+
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return fmt.Errorf("invalid key_binary (expected true, false, 'mtime', or 'content')")
+	}
+	switch BinaryFingerprint(name) {
+	case BINARY_FINGERPRINT_MTIME, BINARY_FINGERPRINT_CONTENT:
+		*f = BinaryFingerprint(name)
+	default:
+		return fmt.Errorf("invalid key_binary '%s' (expected true, false, 'mtime', or 'content')", name)
+	}
+	return nil
+}
+
+type CacheConfig struct {
+	MaxEntries int `yaml:"max_entries"`
+
+	// Whether to gzip cached stdout/stderr
+	Compress bool `yaml:"compress,omitempty"`
+
+	// Whether to make entries readable only by their owner, for output which
+	// may contain secrets
+	Private bool `yaml:"private,omitempty"`
+
+	// When true (the default), concurrent invocations of the same command
+	// on a cold cache wait for the first to finish and then read its result,
+	// rather than all executing the real command.
+	SingleFlight *bool `yaml:"single_flight,omitempty"`
+
+	// Results whose stdout and stderr together exceed this many bytes are
+	// shown but not cached. Zero means unlimited.
+	MaxOutputBytes int64 `yaml:"max_output_bytes,omitempty"`
+
+	// Shared cache which entries are also read from and written to
+	Remote RemoteConfig `yaml:"remote,omitempty"`
+}
+
+func (c CacheConfig) SingleFlightEnabled() bool {
+	return c.SingleFlight == nil || *c.SingleFlight
+}
+
+// Set either Bucket (for S3) or URL (for a plain HTTP server)
+type RemoteConfig struct {
+	// S3 bucket holding entries. Credentials come from the standard AWS
+	// sources: environment variables, the shared credentials file, or the
+	// container or instance role.
+	Bucket string `yaml:"bucket,omitempty"`
+	Region string `yaml:"region,omitempty"`
+
+	// Prepended to each entry's object keys, e.g. "cachenv/"
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Endpoint of an S3-compatible service (e.g. MinIO) to use instead of AWS
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Base URL of an HTTP server holding entries, which are read with GET
+	// and written with PUT
+	URL string `yaml:"url,omitempty"`
+
+	// Sent to the HTTP server as a bearer token. Overridden by
+	// $CACHENV_REMOTE_TOKEN, to keep it out of the config.
+	Token string `yaml:"token,omitempty"`
+
+	// How long each request may take (default: 10s)
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// When true (the default), entries are looked up in the local cache before
+	// the remote one, and remote hits are copied locally
+	ReadThrough *bool `yaml:"read_through,omitempty"`
+}
+
+func (r RemoteConfig) ReadThroughEnabled() bool {
+	return r.ReadThrough == nil || *r.ReadThrough
+}
+
+func (r RemoteConfig) TimeoutOrDefault() time.Duration {
+	if r.Timeout == 0 {
+		return DEFAULT_REMOTE_TIMEOUT
+	}
+	return r.Timeout
+}
+
+// How cache keys are hashed. The zero value is full-length SHA-256.
+type HashConfig struct {
+	// "sha256" (the default) or "blake2b"
+	Algo string `yaml:"algo,omitempty"`
+
+	// Number of bytes of the digest to keep. Shorter keys make shorter
+	// directory names, at a greater (though for a local cache, still tiny)
+	// risk of collisions. Zero keeps the whole digest.
+	Length int `yaml:"length,omitempty"`
+}
+
+type Config struct {
+	// Options which apply to every memoized command that doesn't set them
+	// itself, e.g. a ttl. See CommandConfig.WithDefaults.
+	Defaults CommandConfig `yaml:"defaults,omitempty"`
+
+	// List of commands to memoize
+	Commands map[string]CommandConfig `yaml:"memoize_commands"`
+	Cache    CacheConfig              `yaml:"cache"`
+
+	// External program used by 'cachenv diff', e.g. "delta", invoked with the
+	// cached stdout's path and "-" for the live stdout. Overridden by
+	// $CACHENV_DIFF. Unset uses the built-in diff.
+	DiffTool string `yaml:"diff_tool,omitempty"`
+
+	// How cache keys are hashed. Changing this makes all existing entries
+	// miss.
+	Hash HashConfig `yaml:"hash,omitempty"`
+
+	// Absolute path of a directory, e.g. node_exporter's textfile collector
+	// directory, in which Prometheus metrics (hits, misses, entries and bytes)
+	// are written after each invocation, to a file named for this cachenv
+	Metrics string `yaml:"metrics,omitempty"`
+
+	// Absolute path of a file to which a line is appended for each
+	// invocation of a memoized command (whether it hit, its exit code, etc.)
+	LogFile string `yaml:"log_file,omitempty"`
+
+	// Size beyond which the log file is rotated. Zero means
+	// DEFAULT_LOG_MAX_BYTES.
+	LogMaxBytes int64 `yaml:"log_max_bytes,omitempty"`
+
+	// Other names for memoized commands, e.g. "g: git". An alias is
+	// intercepted like its command, runs it, and shares its config and
+	// entries.
+	Aliases map[string]string `yaml:"aliases,omitempty"`
+}
+
+// Returns a copy of the config whose commands have Defaults applied
+func (c Config) Resolved() Config {
+	commands := make(map[string]CommandConfig, len(c.Commands))
+	for cmd, cmdConfig := range c.Commands {
+		commands[cmd] = cmdConfig.WithDefaults(c.Defaults)
+	}
+	c.Commands = commands
+	return c
+}
+
+// Returns the memoized command which cmd names: the command it's an alias
+// for, if any, otherwise cmd itself
+func (c Config) Canonical(cmd string) string {
+	if target, ok := c.Aliases[cmd]; ok {
+		return target
+	}
+	return cmd
+}
+
+// Returns the output size limit for cmd, which may be set per command or for
+// the whole cache. Zero means unlimited.
+func (c Config) MaxOutputBytesFor(cmd string) int64 {
+	if limit := c.Commands[cmd].MaxOutputBytes; limit != 0 {
+		return limit
+	}
+	return c.Cache.MaxOutputBytes
+}
+
+// A problem with the configuration of a particular command
+type CommandError struct {
+	Command string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("memoize_commands.%s: %v", e.Command, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Returns every invalid value in the config
+func (c Config) Problems() []error {
+	var problems []error
+	if c.Cache.MaxEntries < 0 {
+		problems = append(problems, fmt.Errorf("cache.max_entries must not be negative"))
+	}
+	if c.Cache.MaxOutputBytes < 0 {
+		problems = append(problems, fmt.Errorf("cache.max_output_bytes must not be negative"))
+	}
+	if c.Cache.Remote.Bucket != "" && c.Cache.Remote.URL != "" {
+		problems = append(problems, fmt.Errorf("cache.remote may set either bucket or url, not both"))
+	}
+	if c.Cache.Remote.Timeout < 0 {
+		problems = append(problems, fmt.Errorf("cache.remote.timeout must not be negative"))
+	}
+	if err := c.Hash.Validate(); err != nil {
+		problems = append(problems, err)
+	}
+	if c.Metrics != "" && !filepath.IsAbs(c.Metrics) {
+		problems = append(problems, fmt.Errorf("metrics must be an absolute path"))
+	}
+	if c.LogFile != "" && !filepath.IsAbs(c.LogFile) {
+		problems = append(problems, fmt.Errorf("log_file must be an absolute path"))
+	}
+	if c.LogMaxBytes < 0 {
+		problems = append(problems, fmt.Errorf("log_max_bytes must not be negative"))
+	}
+	if c.Defaults.Path != "" {
+		problems = append(problems, fmt.Errorf("defaults: path can only be set per command"))
+	}
+	for _, problem := range c.Defaults.problems() {
+		problems = append(problems, fmt.Errorf("defaults: %w", problem))
+	}
+
+	commands := make([]string, 0, len(c.Commands))
+	for cmd := range c.Commands {
+		commands = append(commands, cmd)
+	}
+	sort.Strings(commands)
+	for _, cmd := range commands {
+		for _, problem := range c.Commands[cmd].problems() {
+			problems = append(problems, &CommandError{cmd, problem})
+		}
+	}
+
+	aliases := make([]string, 0, len(c.Aliases))
+	for alias := range c.Aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		target := c.Aliases[alias]
+		if strings.Contains(alias, "/") || alias == "cachenv" {
+			problems = append(problems, fmt.Errorf("aliases.%s: invalid alias name", alias))
+		} else if _, ok := c.Commands[alias]; ok {
+			problems = append(problems, fmt.Errorf("aliases.%s: is also a memoized command", alias))
+		} else if _, ok := c.Commands[target]; !ok {
+			problems = append(problems, fmt.Errorf("aliases.%s: '%s' is not a memoized command", alias, target))
+		}
+	}
+	return problems
+}
+
+// Returns every invalid value in a command's config (or the defaults)
+func (c CommandConfig) problems() []error {
+	var problems []error
+	for _, problem := range []struct {
+		invalid bool
+		message string
+	}{
+		{c.TTL < 0, "ttl must not be negative"},
+		{c.FailureTTL != nil && *c.FailureTTL < 0, "failure_ttl must not be negative"},
+		{c.Timeout < 0, "timeout must not be negative"},
+		{c.MaxOutputBytes < 0, "max_output_bytes must not be negative"},
+		{c.Path != "" && !filepath.IsAbs(c.Path), "path must be absolute"},
+		{c.KeyArgs != nil && (c.IgnoreArgs != nil || c.VolatileArgs != nil),
+			"key_args can't be combined with ignore_args or volatile_args"},
+	} {
+		if problem.invalid {
+			problems = append(problems, errors.New(problem.message))
+		}
+	}
+	for _, pattern := range c.KeyArgs {
+		if strings.HasPrefix(pattern, "$") {
+			if n, err := strconv.Atoi(pattern[1:]); err != nil || n < 1 {
+				problems = append(problems, fmt.Errorf("invalid key_args position '%s' (expected e.g. '$1')", pattern))
+			}
+		}
+	}
+	for _, pattern := range c.VolatileArgs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			problems = append(problems, fmt.Errorf("invalid volatile_args pattern '%s'", pattern))
+		}
+	}
+	for _, pattern := range c.BypassIfArgs {
+		if !strings.HasPrefix(pattern, "-") {
+			problems = append(problems, fmt.Errorf("invalid bypass_if_args '%s' (expected a flag, e.g. '--refresh')", pattern))
+		}
+	}
+	return problems
+}
+
+// Returns an error describing every invalid value in the config, or nil
+func (c Config) Validate() error {
+	return errors.Join(c.Problems()...)
+}
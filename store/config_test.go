@@ -0,0 +1,118 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestCachesFailures(t *testing.T) {
+	zero, minute := time.Duration(0), time.Minute
+	tests := []struct {
+		name     string
+		config   CommandConfig
+		exitCode int
+		expected bool
+	}{
+		{"success by default", CommandConfig{}, 0, true},
+		{"failure by default", CommandConfig{}, 1, false},
+		{"failure with failure_ttl", CommandConfig{FailureTTL: &minute}, 1, true},
+		{"failure with zero failure_ttl", CommandConfig{FailureTTL: &zero}, 1, false},
+		{"failure not in cache_on", CommandConfig{FailureTTL: &minute, CacheOn: CachePolicy{ExitCodes: []int{0, 2}}}, 1, false},
+		{"failure in cache_on", CommandConfig{FailureTTL: &minute, CacheOn: CachePolicy{ExitCodes: []int{0, 2}}}, 2, true},
+		{"success not in cache_on", CommandConfig{CacheOn: CachePolicy{ExitCodes: []int{2}}}, 0, false},
+	}
+	for _, test := range tests {
+		if actual := test.config.Caches(test.exitCode); actual != test.expected {
+			t.Errorf("%s: Caches(%d) = %v, expected %v", test.name, test.exitCode, actual, test.expected)
+		}
+	}
+	if ttl := (CommandConfig{TTL: time.Hour, FailureTTL: &minute}).TTLFor(1); ttl != minute {
+		t.Errorf("TTLFor(1) = %s, expected %s", ttl, minute)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	var config Config
+	err := yaml.Unmarshal([]byte(`
+defaults:
+  ttl: 1h
+  cache_on: success
+  ignore_args: ["--color"]
+  strip_ansi: true
+memoize_commands:
+  ls:
+    path: /bin/ls
+    ttl: 5m
+    ignore_args: ["-v"]
+  git:
+    key_args: ["$1"]
+  cat: {}
+`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := config.Resolved().Commands
+
+	ls := commands["ls"]
+	if ls.TTL != 5*time.Minute || !reflect.DeepEqual(ls.IgnoreArgs, []string{"-v"}) || ls.Path != "/bin/ls" {
+		t.Errorf("ls's own options were overridden: %+v", ls)
+	}
+	if ls.CacheOn.Name != "success" || !ls.StripANSI {
+		t.Errorf("ls didn't inherit unset options: %+v", ls)
+	}
+
+	cat := commands["cat"]
+	if cat.TTL != time.Hour || !reflect.DeepEqual(cat.IgnoreArgs, []string{"--color"}) || !cat.StripANSI || cat.Path != "" {
+		t.Errorf("cat = %+v, want the defaults", cat)
+	}
+
+	if git := commands["git"]; git.IgnoreArgs != nil || git.TTL != time.Hour {
+		t.Errorf("git = %+v, want the defaults except ignore_args", git)
+	}
+
+	if config.Commands["cat"].TTL != 0 {
+		t.Error("Resolved modified the original config")
+	}
+}
+
+func TestDefaultsTurnedOff(t *testing.T) {
+	data := []byte(`
+defaults:
+  skip_if_tty: true
+  replay_delay: true
+  max_output_bytes: 1000
+memoize_commands:
+  ls:
+    skip_if_tty: false
+    replay_delay: false
+    max_output_bytes: 0
+  cat: {}
+`)
+	var config Config
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Also once written back and read again, as when the config is updated
+	written, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reread Config
+	if err := yaml.UnmarshalStrict(written, &reread); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []Config{config, reread} {
+		commands := c.Resolved().Commands
+		if ls := commands["ls"]; ls.SkipIfTTY || ls.ReplayDelay || ls.MaxOutputBytes != 0 {
+			t.Errorf("ls didn't turn off the defaults: %+v", ls)
+		}
+		if cat := commands["cat"]; !cat.SkipIfTTY || !cat.ReplayDelay || cat.MaxOutputBytes != 1000 {
+			t.Errorf("cat didn't inherit the defaults: %+v", cat)
+		}
+	}
+}
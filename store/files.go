@@ -0,0 +1,75 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/* Output files */
+
+// A file written by a command (rather than to its stdout), captured so it can
+// be restored on hits
+type OutputFile struct {
+	// As the command was told to write it: relative to its working directory,
+	// or absolute
+	Path string
+
+	Mode os.FileMode
+	Data []byte
+}
+
+func (s *FSStore) filesPath(key CacheKey) string {
+	return filepath.Join(s.KeyDir(key), "files")
+}
+
+// Encodes files as a tar archive, the form in which entries store them
+func encodeFiles(files []OutputFile) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.Path,
+			Mode:     int64(file.Mode.Perm()),
+			Size:     int64(len(file.Data)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(file.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decodes files encoded by encodeFiles. The result is non-nil even if there
+// are no files, as a recorded empty set differs from none being recorded.
+func decodeFiles(data []byte) ([]OutputFile, error) {
+	files := []OutputFile{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode output files: %w", err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode output files: %w", err)
+		}
+		files = append(files, OutputFile{
+			Path: header.Name,
+			Mode: os.FileMode(header.Mode).Perm(),
+			Data: contents,
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+/* Key hashing */
+
+const (
+	HASH_SHA256  = "sha256"
+	HASH_BLAKE2B = "blake2b"
+)
+
+// Shortest digest, in bytes, which a key may be truncated to
+const MIN_HASH_LENGTH = 8
+
+// Returns an error if h names an unknown algorithm or an invalid length
+func (h HashConfig) Validate() error {
+	if h.Algo != "" && h.Algo != HASH_SHA256 && h.Algo != HASH_BLAKE2B {
+		return fmt.Errorf("invalid hash.algo '%s' (expected '%s' or '%s')", h.Algo, HASH_SHA256, HASH_BLAKE2B)
+	}
+	if h.Length != 0 && (h.Length < MIN_HASH_LENGTH || h.Length > h.digestSize()) {
+		return fmt.Errorf("invalid hash.length %d (expected %d to %d bytes)", h.Length, MIN_HASH_LENGTH, h.digestSize())
+	}
+	return nil
+}
+
+func (h HashConfig) algo() string {
+	if h.Algo == "" {
+		return HASH_SHA256
+	}
+	return h.Algo
+}
+
+func (h HashConfig) digestSize() int {
+	if h.algo() == HASH_BLAKE2B {
+		return blake2b.Size
+	}
+	return sha256.Size
+}
+
+func (h HashConfig) length() int {
+	if h.Length == 0 {
+		return h.digestSize()
+	}
+	return h.Length
+}
+
+// Returns the digest of data, truncated to the configured length
+func (h HashConfig) sum(data []byte) []byte {
+	var digest []byte
+	if h.algo() == HASH_BLAKE2B {
+		sum := blake2b.Sum512(data)
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	}
+	return digest[:h.length()]
+}
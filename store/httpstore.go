@@ -0,0 +1,87 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/* HTTP remote storage */
+
+// Store which keeps entries on an HTTP server, layered over the local store.
+// Objects are read with GET (and HEAD) from <url>/<hash>/{out,err,status} and
+// written with PUT, so any server which stores what's PUT will do.
+type HTTPStore struct {
+	remoteStore
+
+	URL   string
+	Token string
+
+	client *http.Client
+}
+
+func NewHTTPStore(config RemoteConfig, local *FSStore) *HTTPStore {
+	token := config.Token
+	if envToken, ok := os.LookupEnv("CACHENV_REMOTE_TOKEN"); ok {
+		token = envToken
+	}
+	s := &HTTPStore{
+		URL:    strings.TrimSuffix(config.URL, "/"),
+		Token:  token,
+		client: &http.Client{Timeout: config.TimeoutOrDefault()},
+	}
+	s.remoteStore = newRemoteStore(config, local, s)
+	return s
+}
+
+func (s *HTTPStore) KeyDir(key CacheKey) string {
+	return s.URL + "/" + key.Hash
+}
+
+func (s *HTTPStore) head(name string) (time.Time, error) {
+	resp, err := s.do(http.MethodHead, name, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+func (s *HTTPStore) get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *HTTPStore) put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Sends a request for an object, failing unless the response is a success. A
+// missing object yields an error matching os.ErrNotExist.
+func (s *HTTPStore) do(method, name string, body []byte) (*http.Response, error) {
+	url := s.URL + "/" + name
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return checkResponse(resp, url)
+}
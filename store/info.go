@@ -0,0 +1,62 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+/* Entry summaries */
+
+// Summary of a single cache entry
+type EntryInfo struct {
+	Hash        string `json:"hash"`
+	CommandLine string `json:"command"`
+	Created     string `json:"created,omitempty"`
+	Duration    string `json:"duration,omitempty"`
+	ExitCode    int    `json:"exit_code"`
+	StdoutBytes int64  `json:"stdout_bytes"`
+	StderrBytes int64  `json:"stderr_bytes"`
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Returns a summary of the entry for key, without reading its output
+func (s *FSStore) Info(key CacheKey) (EntryInfo, error) {
+	info := EntryInfo{Hash: key.Hash}
+
+	meta, err := s.ReadMeta(key)
+	if err != nil {
+		return info, err
+	}
+	info.CommandLine = meta.CommandLine()
+	if !meta.Created.IsZero() {
+		info.Created = meta.Created.Format(time.RFC3339)
+	}
+	if meta.Duration >= time.Millisecond {
+		info.Duration = meta.Duration.Round(time.Millisecond).String()
+	} else if meta.Duration > 0 {
+		info.Duration = meta.Duration.Round(time.Microsecond).String()
+	}
+
+	if info.ExitCode, err = s.ReadExitCode(key); errors.Is(err, ErrInvalidStatus) {
+		// Still list the entry; it will be replaced when next used
+		info.ExitCode = -1
+	} else if err != nil {
+		return info, fmt.Errorf("failed to read exit code for %s: %w", key.Hash, err)
+	}
+	if info.StdoutBytes, err = fileSize(ResolveOutputPath(s.stdoutPath(key))); err != nil {
+		return info, err
+	}
+	if info.StderrBytes, err = fileSize(ResolveOutputPath(s.stderrPath(key))); err != nil {
+		return info, err
+	}
+	return info, nil
+}
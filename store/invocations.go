@@ -0,0 +1,61 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+/* Invocation log */
+
+// Size beyond which the invocation log is rotated, unless configured
+const DEFAULT_LOG_MAX_BYTES = 10_000_000
+
+// One invocation of a memoized command, as recorded in the invocation log
+type Invocation struct {
+	Time     time.Time `json:"time"`
+	Command  string    `json:"command"`
+	Hash     string    `json:"hash"`
+	Hit      bool      `json:"hit"`
+	ExitCode int       `json:"exit_code"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// Appends inv to the log at path as a line of JSON. Once the log would grow
+// beyond maxBytes (zero meaning DEFAULT_LOG_MAX_BYTES), it's first moved
+// aside to path.1, replacing the previous one. The store lock is held
+// meanwhile, so that concurrent invocations neither interleave lines nor
+// rotate twice.
+func (s *FSStore) LogInvocation(path string, maxBytes int64, inv Invocation) error {
+	return s.withLock(func() error {
+		return appendInvocation(path, maxBytes, inv, s.FileMode())
+	})
+}
+
+// Appends inv to the log at path, as LogInvocation describes. The caller
+// ensures that only one invocation appends at a time.
+func appendInvocation(path string, maxBytes int64, inv Invocation, mode os.FileMode) error {
+	line, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if maxBytes == 0 {
+		maxBytes = DEFAULT_LOG_MAX_BYTES
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(len(line)) > maxBytes {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
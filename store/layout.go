@@ -0,0 +1,171 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Layout */
+
+// Length of the hash prefix by which entries are sharded into subdirectories
+// of the store directory (ab/abcdef...), so that no single directory grows too
+// large to list or search quickly
+const SHARD_LEN = 2
+
+// Returns the name of the shard directory holding the entry with hash
+func shard(hash string) string {
+	if len(hash) < SHARD_LEN {
+		return hash
+	}
+	return hash[:SHARD_LEN]
+}
+
+// Reports whether name is that of a shard directory, as opposed to e.g. the
+// blobs or a staging directory
+func isShard(name string) bool {
+	return len(name) == SHARD_LEN && IsHex(name)
+}
+
+func (s *FSStore) KeyDir(key CacheKey) string {
+	return filepath.Join(s.Dir, shard(key.Hash), key.Hash)
+}
+
+// Returns the keys of all entries in the store
+func (s *FSStore) Keys() ([]CacheKey, error) {
+	shards, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read store directory: %w", err)
+	}
+
+	var keys []CacheKey
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShard(shard.Name()) {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.Dir, shard.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read store directory: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), STAGING_PREFIX) {
+				continue
+			}
+			key := CacheKey{Hash: entry.Name()}
+			if s.Exists(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Moves entries stored directly in the store directory, as by versions before
+// sharding, into the sharded layout. An entry which has since been written in
+// the sharded layout takes precedence over its flat counterpart, which is
+// removed. Returns the number of entries moved.
+func (s *FSStore) Migrate() (int, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read store directory: %w", err)
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !IsHex(entry.Name()) || isShard(entry.Name()) {
+			continue
+		}
+		key := CacheKey{Hash: entry.Name()}
+		flat := filepath.Join(s.Dir, entry.Name())
+		if s.Exists(key) {
+			if err := os.RemoveAll(flat); err != nil {
+				return moved, fmt.Errorf("failed to remove entry %s: %w", key.Hash, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(s.KeyDir(key)), s.DirMode()); err != nil {
+			return moved, err
+		}
+		// Clear out a partial entry (e.g. just a lock file) in the way
+		if err := os.RemoveAll(s.KeyDir(key)); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(flat, s.KeyDir(key)); err != nil {
+			return moved, fmt.Errorf("failed to migrate entry %s: %w", key.Hash, err)
+		}
+		moved++
+	}
+	if moved > 0 {
+		s.InvalidateUsage()
+	}
+	return moved, nil
+}
+
+// Reports whether s is a non-empty string of lowercase hex digits, as entry
+// hashes are
+func IsHex(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Returned by ResolvePrefix when no entry's hash starts with the prefix
+var ErrNoEntry = errors.New("no cached entry")
+
+// Returns the key of the entry whose hash starts with prefix, as git resolves
+// abbreviated commit hashes. Fails if no entry or more than one matches.
+func (s *FSStore) ResolvePrefix(prefix string) (CacheKey, error) {
+	if !IsHex(prefix) {
+		return CacheKey{}, fmt.Errorf("invalid hash '%s'", prefix)
+	}
+
+	// A prefix at least as long as a shard's name can only match in that shard
+	var shards []string
+	if len(prefix) >= SHARD_LEN {
+		shards = []string{shard(prefix)}
+	} else {
+		dirs, err := os.ReadDir(s.Dir)
+		if err != nil && !os.IsNotExist(err) {
+			return CacheKey{}, fmt.Errorf("failed to read store directory: %w", err)
+		}
+		for _, dir := range dirs {
+			if dir.IsDir() && isShard(dir.Name()) && strings.HasPrefix(dir.Name(), prefix) {
+				shards = append(shards, dir.Name())
+			}
+		}
+	}
+
+	var matches []CacheKey
+	for _, shard := range shards {
+		entries, err := os.ReadDir(filepath.Join(s.Dir, shard))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return CacheKey{}, fmt.Errorf("failed to read store directory: %w", err)
+		}
+		for _, entry := range entries {
+			key := CacheKey{Hash: entry.Name()}
+			if entry.IsDir() && strings.HasPrefix(key.Hash, prefix) && s.Exists(key) {
+				matches = append(matches, key)
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return CacheKey{}, fmt.Errorf("%w %s", ErrNoEntry, prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return CacheKey{}, fmt.Errorf("hash prefix %s is ambiguous: it matches %d entries", prefix, len(matches))
+	}
+}
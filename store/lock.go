@@ -0,0 +1,159 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* Locking */
+
+// Acquires an exclusive advisory lock on the file at path (creating it if
+// needed), blocking until the lock is available. The returned function
+// releases the lock.
+//
+// The file may be removed (see GCLocks) while we wait for it, leaving us
+// holding a lock nobody else will see, so then we lock the new one instead.
+func lockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+		unlock, err := flock(f)
+		if err != nil {
+			return nil, err
+		}
+		if isLockedPath(f, path) {
+			return unlock, nil
+		}
+		unlock()
+	}
+}
+
+// Reports whether path still names the open file f
+func isLockedPath(f *os.File, path string) bool {
+	held, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(held, current)
+}
+
+// Acquires an exclusive advisory lock on the directory at path, blocking
+// until the lock is available. The returned function releases the lock.
+func LockDir(path string) (func(), error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return flock(dir)
+}
+
+// Runs fn while holding an exclusive lock on the store directory. This
+// serializes read-modify-write cycles of the files shared by all entries (the
+// LRU index and stats), which would otherwise lose updates or be corrupted by
+// concurrent invocations. The lock is released even if fn panics.
+//
+// flock is advisory, and on some network filesystems (e.g. NFS) it is either
+// emulated with byte-range locks or silently ignored. There, concurrent
+// invocations on different hosts may still lose index or stats updates; cache
+// entries themselves are unaffected, since they are written atomically.
+func (s *FSStore) withLock(fn func() error) error {
+	if err := os.MkdirAll(s.Dir, s.DirMode()); err != nil {
+		return err
+	}
+	unlock, err := LockDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// Suffix of the file beside each entry's directory which is locked while the
+// entry is populated. It's kept outside the directory, which writes replace
+// wholesale; entries written by older versions may still hold a file of this
+// name.
+const LOCK_NAME = "lock"
+
+func (s *FSStore) lockPath(key CacheKey) string {
+	return filepath.Join(filepath.Dir(s.KeyDir(key)), "."+key.Hash+"."+LOCK_NAME)
+}
+
+// Acquires an exclusive lock on the entry for key, blocking while another
+// process holds it. The returned function releases the lock.
+func (s *FSStore) Lock(key CacheKey) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.KeyDir(key)), s.DirMode()); err != nil {
+		return nil, err
+	}
+	return lockFile(s.lockPath(key))
+}
+
+// Removes the lock files of entries which no longer exist, returning how many
+// were removed. Removing an entry keeps its lock file, which another process
+// may hold or be waiting on; here, each is only removed while we hold it
+// ourselves, and anyone who was waiting moves on to a new one.
+func (s *FSStore) GCLocks() (int, error) {
+	shards, err := os.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read store directory: %w", err)
+	}
+
+	removed := 0
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShard(shard.Name()) {
+			continue
+		}
+		names, err := os.ReadDir(filepath.Join(s.Dir, shard.Name()))
+		if err != nil {
+			return removed, fmt.Errorf("failed to read store directory: %w", err)
+		}
+		for _, name := range names {
+			hash, ok := strings.CutSuffix(strings.TrimPrefix(name.Name(), "."), "."+LOCK_NAME)
+			if !ok || !strings.HasPrefix(name.Name(), ".") || !IsHex(hash) {
+				continue
+			}
+			key := CacheKey{Hash: hash}
+			if s.Exists(key) {
+				continue
+			}
+			ok, err := s.removeUnheldLock(key)
+			if err != nil {
+				return removed, err
+			}
+			if ok {
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+// Removes the lock file for key unless someone holds it, reporting whether
+// it was removed
+func (s *FSStore) removeUnheldLock(key CacheKey) (bool, error) {
+	path := s.lockPath(key)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	unlock, ok, err := tryFlock(f)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer unlock()
+	if !isLockedPath(f, path) || s.Exists(key) {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		return false, fmt.Errorf("failed to remove lock file: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRemoveKeepsHeldLock(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	key := testKey("a")
+	writeTestEntry(t, s, key)
+
+	unlock, err := s.Lock(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.lockPath(key)); err != nil {
+		t.Errorf("Remove deleted the lock file: %v", err)
+	}
+
+	// While held, the lock file isn't collected, and others still wait on it
+	if removed, err := s.GCLocks(); err != nil || removed != 0 {
+		t.Errorf("GCLocks removed %d held locks, %v", removed, err)
+	}
+	acquired := make(chan func())
+	go func() {
+		unlock, err := s.Lock(key)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a second Lock didn't wait for the first")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	(<-acquired)()
+
+	if removed, err := s.GCLocks(); err != nil || removed != 1 {
+		t.Errorf("GCLocks removed %d unheld locks, %v; want 1", removed, err)
+	}
+	if _, err := os.Stat(s.lockPath(key)); !os.IsNotExist(err) {
+		t.Errorf("unheld lock file of a removed entry remains: %v", err)
+	}
+}
+
+func TestLockAfterLockFileRemoved(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	key := testKey("a")
+
+	// Someone waits on a lock file which is then removed
+	unlock, err := s.Lock(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan func())
+	go func() {
+		unlock, err := s.Lock(key)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Remove(s.lockPath(key)); err != nil {
+		t.Fatal(err)
+	}
+	third, err := s.Lock(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	// The waiter moves on to the new lock file, which is held
+	select {
+	case <-acquired:
+		t.Error("waiter took a lock on a removed lock file")
+	case <-time.After(100 * time.Millisecond):
+	}
+	third()
+	(<-acquired)()
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* LRU eviction */
+
+// Name of the file in FSStore.Dir recording entry hashes in order of use. Each
+// use is appended, so a hash's last line is its most recent use.
+const INDEX_NAME = "index"
+
+// The index is compacted, to hold each hash once, when it has more than this
+// many times MaxEntries lines
+const INDEX_SLACK = 2
+
+// Tracks keys in order of use, evicting the least recently used once there
+// are more than Capacity. A Capacity of zero or less means unbounded.
+type LRUCache struct {
+	Capacity int
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		Capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Marks hash as the most recently used, returning any hashes evicted to stay
+// within Capacity
+func (c *LRUCache) Add(hash string) []string {
+	if elem, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[hash] = c.order.PushFront(hash)
+	}
+	return c.Trim()
+}
+
+// Evicts the least recently used hashes until within Capacity, returning them
+func (c *LRUCache) Trim() []string {
+	var evicted []string
+	for c.Capacity > 0 && c.order.Len() > c.Capacity {
+		oldest := c.order.Back()
+		hash := oldest.Value.(string)
+		c.order.Remove(oldest)
+		delete(c.entries, hash)
+		evicted = append(evicted, hash)
+	}
+	return evicted
+}
+
+func (c *LRUCache) Remove(hash string) {
+	if elem, ok := c.entries[hash]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, hash)
+	}
+}
+
+func (c *LRUCache) Len() int {
+	return c.order.Len()
+}
+
+// Returns the tracked hashes, least recently used first
+func (c *LRUCache) Hashes() []string {
+	hashes := make([]string, 0, c.order.Len())
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		hashes = append(hashes, elem.Value.(string))
+	}
+	return hashes
+}
+
+func (s *FSStore) indexPath() string {
+	return filepath.Join(s.Dir, INDEX_NAME)
+}
+
+// Returns the hashes in the index, in order of use, with any repeats
+func (s *FSStore) readIndex() ([]string, error) {
+	f, err := os.Open(s.indexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer f.Close()
+
+	var hashes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+			hashes = append(hashes, hash)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	return hashes, nil
+}
+
+// Builds an LRUCache from the persisted index. Entries missing from the index
+// (e.g. written by an older cachenv, or while MaxEntries was unset) are
+// treated as least recently used, oldest first; indexed hashes which no longer
+// exist are dropped.
+func (s *FSStore) LoadLRU() (*LRUCache, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	onDisk := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		onDisk[key.Hash] = true
+	}
+
+	hashes, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var indexed []string
+	isIndexed := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		if onDisk[hash] {
+			indexed = append(indexed, hash)
+			isIndexed[hash] = true
+		}
+	}
+
+	// Stat each entry once, not on every comparison
+	type aged struct {
+		hash string
+		age  time.Duration
+	}
+	var unindexed []aged
+	for _, key := range keys {
+		if !isIndexed[key.Hash] {
+			age, _ := s.Age(key)
+			unindexed = append(unindexed, aged{key.Hash, age})
+		}
+	}
+	sort.SliceStable(unindexed, func(i, j int) bool {
+		return unindexed[i].age > unindexed[j].age
+	})
+
+	lru := NewLRUCache(0)
+	for _, entry := range unindexed {
+		lru.Add(entry.hash)
+	}
+	for _, hash := range indexed {
+		lru.Add(hash)
+	}
+	lru.Capacity = s.MaxEntries
+	return lru, nil
+}
+
+// Persists the order of lru to the index
+func (s *FSStore) SaveLRU(lru *LRUCache) error {
+	f, err := os.CreateTemp(s.Dir, "."+INDEX_NAME+"-")
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	for _, hash := range lru.Hashes() {
+		fmt.Fprintln(w, hash)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := os.Rename(f.Name(), s.indexPath()); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// Records a use of the entry for key, for evicting the least recently used
+// entries once the store holds more than MaxEntries. Uses are only recorded
+// if MaxEntries is set. Each is appended to the index, which is only read
+// back when it has grown enough to need compacting.
+func (s *FSStore) MarkUsed(key CacheKey) error {
+	if s.MaxEntries <= 0 {
+		return nil
+	}
+	return s.withLock(func() error {
+		if err := s.appendIndex(key.Hash); err != nil {
+			return err
+		}
+		info, err := os.Stat(s.indexPath())
+		if err != nil {
+			return fmt.Errorf("failed to stat index: %w", err)
+		}
+		if info.Size() > int64(INDEX_SLACK*s.MaxEntries*(len(key.Hash)+1)) {
+			return s.compactIndex()
+		}
+		return nil
+	})
+}
+
+// Records that the entry for key was just written, like MarkUsed, evicting
+// the least recently used entries if the index now names more than
+// MaxEntries
+func (s *FSStore) markWritten(key CacheKey) error {
+	if s.MaxEntries <= 0 {
+		return nil
+	}
+	return s.withLock(func() error {
+		if err := s.appendIndex(key.Hash); err != nil {
+			return err
+		}
+		hashes, err := s.readIndex()
+		if err != nil {
+			return err
+		}
+		distinct := make(map[string]bool, len(hashes))
+		for _, hash := range hashes {
+			distinct[hash] = true
+		}
+		if len(distinct) > s.MaxEntries || len(hashes) > INDEX_SLACK*s.MaxEntries {
+			return s.compactIndex()
+		}
+		return nil
+	})
+}
+
+// Appends a use of hash to the index. The caller holds the store lock.
+func (s *FSStore) appendIndex(hash string) error {
+	f, err := os.OpenFile(s.indexPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, s.FileMode())
+	if err != nil {
+		return fmt.Errorf("failed to open index: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, hash); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return f.Close()
+}
+
+// Evicts the least recently used entries beyond MaxEntries and rewrites the
+// index with each remaining hash once. The caller holds the store lock.
+func (s *FSStore) compactIndex() error {
+	lru, err := s.LoadLRU()
+	if err != nil {
+		return err
+	}
+	for _, hash := range lru.Trim() {
+		if _, err := s.remove(CacheKey{Hash: hash}); err != nil {
+			return err
+		}
+	}
+	return s.SaveLRU(lru)
+}
+
+// Rewrites the index to drop entries which no longer exist
+func (s *FSStore) Reindex() error {
+	return s.withLock(func() error {
+		lru, err := s.LoadLRU()
+		if err != nil {
+			return err
+		}
+		return s.SaveLRU(lru)
+	})
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func testKey(name string) CacheKey {
+	sum := sha256.Sum256([]byte(name))
+	return CacheKey{Hash: hex.EncodeToString(sum[:])}
+}
+
+func writeTestEntry(t *testing.T, s *FSStore, key CacheKey) {
+	t.Helper()
+	if err := s.WriteToCache(key, ExecResult{Stdout: []byte(key.Hash)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir(), MaxEntries: 2}
+	a, b, c := testKey("a"), testKey("b"), testKey("c")
+
+	writeTestEntry(t, s, a)
+	writeTestEntry(t, s, b)
+	if err := s.MarkUsed(a); err != nil {
+		t.Fatal(err)
+	}
+	writeTestEntry(t, s, c)
+
+	if !s.Exists(a) || !s.Exists(c) {
+		t.Errorf("recently used entries were evicted")
+	}
+	if s.Exists(b) {
+		t.Errorf("least recently used entry was not evicted")
+	}
+}
+
+func TestLRUCompactsIndex(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir(), MaxEntries: 2}
+	a := testKey("a")
+	writeTestEntry(t, s, a)
+	for i := 0; i < 10; i++ {
+		if err := s.MarkUsed(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes, err := s.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) > INDEX_SLACK*s.MaxEntries {
+		t.Errorf("index has %d lines, expected at most %d", len(hashes), INDEX_SLACK*s.MaxEntries)
+	}
+}
+
+func TestLRUUntrackedWithoutMaxEntries(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	for _, name := range []string{"a", "b", "c"} {
+		key := testKey(name)
+		writeTestEntry(t, s, key)
+		if err := s.MarkUsed(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(s.indexPath()); !os.IsNotExist(err) {
+		t.Errorf("index was written without max_entries")
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected 3 entries, got %d", len(keys))
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+)
+
+/* Memoizing from Go */
+
+// Store used by Memoize. If nil, entries are kept in an FSStore under the
+// user's cache directory (e.g. ~/.cache/cachenv).
+var DefaultStore Store
+
+// Returns the cached result of running cmd with args, or calls run to produce
+// it and caches the result. Results which come with an error or aren't
+// Complete aren't cached.
+func Memoize(cmd string, args []string, run func() (ExecResult, error)) (ExecResult, error) {
+	s := DefaultStore
+	if s == nil {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			// Nowhere to cache
+			return run()
+		}
+		s = &FSStore{Dir: filepath.Join(dir, "cachenv")}
+	}
+	return MemoizeIn(s, cmd, args, run)
+}
+
+// Like Memoize, but caches in s
+func MemoizeIn(s Store, cmd string, args []string, run func() (ExecResult, error)) (ExecResult, error) {
+	key := KeyFrom(cmd, args)
+	if s.Exists(key) {
+		if result, err := s.ReadFromCache(key); err == nil {
+			return result, nil
+		}
+	}
+
+	result, err := run()
+	if err != nil || !result.Complete() {
+		return result, err
+	}
+	return result, s.WriteToCache(key, result)
+}
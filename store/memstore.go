@@ -0,0 +1,166 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/* In-memory storage */
+
+// Store which keeps entries in memory, e.g. for tests. Like FSStore, reading
+// an absent entry fails with an error matching os.ErrNotExist. Entries are
+// never evicted, and locks only exclude other users of the same MemStore.
+type MemStore struct {
+	mu      sync.Mutex
+	entries map[string]memEntry
+	locks   map[string]*sync.Mutex
+	stats   Stats
+
+	// Serializes appends to invocation logs
+	logMu sync.Mutex
+}
+
+type memEntry struct {
+	result  ExecResult
+	meta    EntryMeta
+	written time.Time
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		entries: make(map[string]memEntry),
+		locks:   make(map[string]*sync.Mutex),
+	}
+}
+
+func (s *MemStore) Exists(key CacheKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.entries[key.Hash]
+	return ok
+}
+
+func (s *MemStore) Age(key CacheKey) (time.Duration, error) {
+	entry, err := s.entry(key)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(entry.written), nil
+}
+
+func (s *MemStore) ReadFromCache(key CacheKey) (ExecResult, error) {
+	entry, err := s.entry(key)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	return entry.result, nil
+}
+
+func (s *MemStore) WriteToCache(key CacheKey, result ExecResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Copy the output, so that callers reusing their buffers don't change the
+	// entry
+	result.Stdout = append([]byte(nil), result.Stdout...)
+	result.Stderr = append([]byte(nil), result.Stderr...)
+	now := time.Now()
+	entry := memEntry{result: result, written: now}
+	if key.Command != "" {
+		entry.meta = EntryMeta{
+			Command:        key.Command,
+			Args:           key.Args,
+			Created:        now.UTC(),
+			CachenvVersion: Version,
+			Duration:       result.Duration,
+		}
+	}
+	s.entries[key.Hash] = entry
+	return nil
+}
+
+func (s *MemStore) KeyDir(key CacheKey) string {
+	return "mem:" + key.Hash
+}
+
+func (s *MemStore) ReadExitCode(key CacheKey) (int, error) {
+	entry, err := s.entry(key)
+	if err != nil {
+		return 0, err
+	}
+	return entry.result.ExitCode, nil
+}
+
+func (s *MemStore) ReadMeta(key CacheKey) (EntryMeta, error) {
+	entry, err := s.entry(key)
+	if err != nil {
+		return EntryMeta{}, err
+	}
+	return entry.meta, nil
+}
+
+func (s *MemStore) Lock(key CacheKey) (func(), error) {
+	s.mu.Lock()
+	lock, ok := s.locks[key.Hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[key.Hash] = lock
+	}
+	s.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+func (s *MemStore) MarkUsed(key CacheKey) error {
+	return nil
+}
+
+func (s *MemStore) RecordHit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Hits++
+	return nil
+}
+
+func (s *MemStore) RecordMiss() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Misses++
+	return nil
+}
+
+// Returns the hits and misses recorded so far
+func (s *MemStore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *MemStore) LogInvocation(path string, maxBytes int64, inv Invocation) error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	return appendInvocation(path, maxBytes, inv, 0644)
+}
+
+func (s *MemStore) WriteMetrics(dir, cachenvDir string) error {
+	s.mu.Lock()
+	stats := s.stats
+	var size int64
+	for _, entry := range s.entries {
+		size += int64(len(entry.result.Stdout) + len(entry.result.Stderr))
+	}
+	entries := int64(len(s.entries))
+	s.mu.Unlock()
+	return writeMetricsFile(dir, cachenvDir, stats, entries, size)
+}
+
+func (s *MemStore) entry(key CacheKey) (memEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key.Hash]
+	if !ok {
+		return memEntry{}, fmt.Errorf("no entry for %s: %w", key.Hash, os.ErrNotExist)
+	}
+	return entry, nil
+}
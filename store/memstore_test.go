@@ -0,0 +1,63 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// Exercises the semantics every Store must share
+func testStoreSemantics(t *testing.T, s Store) {
+	key := testKey("a")
+	if s.Exists(key) {
+		t.Error("absent entry exists")
+	}
+	if _, err := s.ReadFromCache(key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("reading absent entry: got %v, want os.ErrNotExist", err)
+	}
+
+	if err := s.WriteToCache(key, ExecResult{Stdout: []byte("out"), Stderr: []byte("err"), ExitCode: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Exists(key) {
+		t.Error("written entry doesn't exist")
+	}
+	result, err := s.ReadFromCache(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "out" || string(result.Stderr) != "err" || result.ExitCode != 3 {
+		t.Errorf("read back %+v", result)
+	}
+	if code, err := s.ReadExitCode(key); err != nil || code != 3 {
+		t.Errorf("ReadExitCode = %d, %v", code, err)
+	}
+	if age, err := s.Age(key); err != nil || age < 0 {
+		t.Errorf("Age = %s, %v", age, err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStoreSemantics(t, NewMemStore())
+}
+
+func TestFSStore(t *testing.T) {
+	testStoreSemantics(t, &FSStore{Dir: t.TempDir()})
+}
+
+func TestMemStoreCopiesOutput(t *testing.T) {
+	s := NewMemStore()
+	key := testKey("a")
+	stdout := []byte("out")
+	if err := s.WriteToCache(key, ExecResult{Stdout: stdout}); err != nil {
+		t.Fatal(err)
+	}
+	stdout[0] = 'X'
+	result, err := s.ReadFromCache(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "out" {
+		t.Errorf("entry changed with the caller's buffer: %q", result.Stdout)
+	}
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* Prometheus metrics */
+
+// Name of the file in FSStore.Dir caching the number and size of entries
+const USAGE_NAME = "usage"
+
+// How long a cached usage is trusted before the store is counted again, to
+// correct for changes not tracked incrementally (e.g. entries edited by hand)
+const USAGE_MAX_AGE = time.Hour
+
+// Escapes a label value as the exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns the number of entries in the store and the space it takes on disk
+// in bytes, as DiskUsage counts it
+func (s *FSStore) Usage() (int, int64, error) {
+	usage, err := s.DiskUsage()
+	if err != nil {
+		return 0, 0, err
+	}
+	return usage.Entries, usage.Bytes, nil
+}
+
+// The result of Usage, as cached in the usage file
+type cachedUsage struct {
+	Entries int64     `yaml:"entries"`
+	Bytes   int64     `yaml:"bytes"`
+	Counted time.Time `yaml:"counted"`
+}
+
+func (s *FSStore) usagePath() string {
+	return filepath.Join(s.Dir, USAGE_NAME)
+}
+
+// Returns the cached usage, if there is one and it's recent enough to trust
+func (s *FSStore) readUsage() (cachedUsage, bool) {
+	var usage cachedUsage
+	data, err := os.ReadFile(s.usagePath())
+	if err != nil || yaml.Unmarshal(data, &usage) != nil {
+		return usage, false
+	}
+	return usage, time.Since(usage.Counted) < USAGE_MAX_AGE
+}
+
+func (s *FSStore) writeUsage(usage cachedUsage) error {
+	data, err := yaml.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.usagePath(), data, 0644)
+}
+
+// Adjusts the cached usage for an entry being written, if it's cached
+func (s *FSStore) addUsage(entries, bytes int64) error {
+	return s.withLock(func() error {
+		usage, ok := s.readUsage()
+		if !ok {
+			return nil
+		}
+		usage.Entries += entries
+		usage.Bytes += bytes
+		return s.writeUsage(usage)
+	})
+}
+
+// Discards the cached usage, so that it's counted again when next needed.
+// Called wherever entries are removed or added other than by WriteToCache.
+func (s *FSStore) InvalidateUsage() {
+	os.Remove(s.usagePath())
+}
+
+// Returns the name of the metrics file for the cachenv in cachenvDir, which
+// is unique to it so that cachenvs sharing a collector directory don't
+// overwrite each other's metrics
+func MetricsFileName(cachenvDir string) string {
+	sum := sha256.Sum256([]byte(cachenvDir))
+	return fmt.Sprintf("cachenv_%x.prom", sum[:6])
+}
+
+// Writes the store's hit/miss counts, entry count and size to this cachenv's
+// file in dir, in the Prometheus text exposition format, e.g. for
+// node_exporter's textfile collector. Each metric is labeled with the cachenv
+// directory. The entry count and size come from the cached usage, which is
+// only recounted from the whole store when missing or stale. The file is
+// replaced atomically while holding the store lock, so concurrent writers
+// never interleave.
+func (s *FSStore) WriteMetrics(dir, cachenvDir string) error {
+	return s.withLock(func() error {
+		stats, err := s.ReadStats()
+		if err != nil {
+			return err
+		}
+		usage, ok := s.readUsage()
+		if !ok {
+			entries, size, err := s.Usage()
+			if err != nil {
+				return err
+			}
+			usage = cachedUsage{Entries: int64(entries), Bytes: size, Counted: time.Now()}
+			if err := s.writeUsage(usage); err != nil {
+				return err
+			}
+		}
+
+		return writeMetricsFile(dir, cachenvDir, stats, usage.Entries, usage.Bytes)
+	})
+}
+
+// Writes the metrics file for the cachenv in cachenvDir to dir, replacing it
+// atomically
+func writeMetricsFile(dir, cachenvDir string, stats Stats, entries, size int64) error {
+	label := fmt.Sprintf(`{cachenv="%s"}`, labelEscaper.Replace(cachenvDir))
+	var buf bytes.Buffer
+	for _, metric := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"cachenv_hits_total", "counter", "Invocations answered from the cache.", stats.Hits},
+		{"cachenv_misses_total", "counter", "Invocations which ran the real command.", stats.Misses},
+		{"cachenv_entries", "gauge", "Entries in the cache.", entries},
+		{"cachenv_bytes", "gauge", "Size of the cache's entries in bytes.", size},
+	} {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", metric.name, metric.kind)
+		fmt.Fprintf(&buf, "%s%s %d\n", metric.name, label, metric.value)
+	}
+
+	path := filepath.Join(dir, MetricsFileName(cachenvDir))
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func readTestMetric(t *testing.T, dir, cachenvDir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, MetricsFileName(cachenvDir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, name+"{") {
+			return line[strings.LastIndex(line, " ")+1:]
+		}
+	}
+	t.Fatalf("no %s in metrics:\n%s", name, data)
+	return ""
+}
+
+func TestWriteMetricsTracksEntries(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	metricsDir := t.TempDir()
+	writeTestEntry(t, s, testKey("a"))
+	if err := s.WriteMetrics(metricsDir, "/project/.cachenv"); err != nil {
+		t.Fatal(err)
+	}
+	if n := readTestMetric(t, metricsDir, "/project/.cachenv", "cachenv_entries"); n != "1" {
+		t.Errorf("cachenv_entries = %s, expected 1", n)
+	}
+
+	// Written entries are added to the cached usage
+	writeTestEntry(t, s, testKey("b"))
+	writeTestEntry(t, s, testKey("b"))
+	usage, ok := s.readUsage()
+	if !ok || usage.Entries != 2 {
+		t.Errorf("cached usage = %+v (%v), expected 2 entries", usage, ok)
+	}
+	if _, size, err := s.Usage(); err != nil || usage.Bytes != size {
+		t.Errorf("cached usage has %d bytes, expected %d as counted (%v)", usage.Bytes, size, err)
+	}
+
+	// Removal makes the next write recount
+	if err := s.Remove(testKey("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteMetrics(metricsDir, "/project/.cachenv"); err != nil {
+		t.Fatal(err)
+	}
+	if n := readTestMetric(t, metricsDir, "/project/.cachenv", "cachenv_entries"); n != "1" {
+		t.Errorf("cachenv_entries = %s after removal, expected 1", n)
+	}
+	_, size, err := s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := readTestMetric(t, metricsDir, "/project/.cachenv", "cachenv_bytes"); n != strconv.FormatInt(size, 10) {
+		t.Errorf("cachenv_bytes = %s, expected %d", n, size)
+	}
+}
+
+func TestMetricsFileNamePerCachenv(t *testing.T) {
+	a, b := MetricsFileName("/a/.cachenv"), MetricsFileName("/b/.cachenv")
+	if a == b {
+		t.Errorf("cachenvs in different directories share metrics file %s", a)
+	}
+	if !strings.HasPrefix(a, "cachenv_") || !strings.HasSuffix(a, ".prom") {
+		t.Errorf("unexpected metrics file name %s", a)
+	}
+}
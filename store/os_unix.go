@@ -0,0 +1,57 @@
+//go:build !windows
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Locks the open file (or directory) f, taking ownership of it. The returned
+// function releases the lock and closes f.
+func flock(f *os.File) (func(), error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Like flock, but fails immediately, reporting false, if f is locked by
+// someone else. f is closed unless the lock is taken.
+func tryFlock(f *os.File) (func(), bool, error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
+
+// Returns the number of hard links to the file described by info, if known
+func linkCount(path string, info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Nlink), true
+}
+
+// Identifies the file described by info by device and inode, if known, so
+// that hardlinks to it are counted once
+func fileID(path string, info os.FileInfo) (fileKey, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{uint64(stat.Dev), uint64(stat.Ino)}, true
+}
@@ -0,0 +1,87 @@
+//go:build windows
+
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// Name of the file locked in place of a directory, which Windows can't lock
+const DIR_LOCK_NAME = ".lock"
+
+// Locks the open file (or directory) f, taking ownership of it. The returned
+// function releases the lock and closes f.
+func flock(f *os.File) (func(), error) {
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		path := filepath.Join(f.Name(), DIR_LOCK_NAME)
+		f.Close()
+		var err error
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644); err != nil {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+	}
+
+	overlapped := new(windows.Overlapped)
+	handle := windows.Handle(f.Fd())
+	if err := windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, overlapped); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+	return func() {
+		windows.UnlockFileEx(handle, 0, 1, 0, overlapped)
+		f.Close()
+	}, nil
+}
+
+// Like flock, but fails immediately, reporting false, if f is locked by
+// someone else. f is closed unless the lock is taken.
+func tryFlock(f *os.File) (func(), bool, error) {
+	overlapped := new(windows.Overlapped)
+	handle := windows.Handle(f.Fd())
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err := windows.LockFileEx(handle, flags, 0, 1, 0, overlapped); err != nil {
+		f.Close()
+		if err == windows.ERROR_LOCK_VIOLATION {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to lock %s: %w", f.Name(), err)
+	}
+	return func() {
+		windows.UnlockFileEx(handle, 0, 1, 0, overlapped)
+		f.Close()
+	}, true, nil
+}
+
+// Returns the number of hard links to the file at path, if known. Unlike on
+// POSIX systems, info doesn't carry it.
+func linkCount(path string, info os.FileInfo) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	var data windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(windows.Handle(f.Fd()), &data); err != nil {
+		return 0, false
+	}
+	return uint64(data.NumberOfLinks), true
+}
+
+// Identifies the file at path by volume and file index, if known, so that
+// hardlinks to it are counted once
+func fileID(path string, info os.FileInfo) (fileKey, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileKey{}, false
+	}
+	defer f.Close()
+	var data windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(windows.Handle(f.Fd()), &data); err != nil {
+		return fileKey{}, false
+	}
+	return fileKey{uint64(data.VolumeSerialNumber), uint64(data.FileIndexHigh)<<32 | uint64(data.FileIndexLow)}, true
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+/* Permissions */
+
+// Mode of the files making up entries
+func (s *FSStore) FileMode() os.FileMode {
+	if s.Private {
+		return 0600
+	}
+	return 0644
+}
+
+// Mode of the store's directories
+func (s *FSStore) DirMode() os.FileMode {
+	if s.Private {
+		return 0700
+	}
+	return 0755
+}
+
+// Applies FileMode and DirMode to everything in the store, e.g. to make
+// entries written before Private was set private. Returns the number of files
+// and directories changed.
+func (s *FSStore) Chmod() (int, error) {
+	changed := 0
+	err := filepath.WalkDir(s.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.Dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		mode := s.FileMode()
+		if entry.IsDir() {
+			mode = s.DirMode()
+		} else if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm() == mode {
+			return nil
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		changed++
+		return nil
+	})
+	return changed, err
+}
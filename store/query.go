@@ -0,0 +1,105 @@
+package store
+
+import (
+	"time"
+)
+
+/* Querying entries */
+
+// Returns the keys of entries written by a cachenv older than version.
+// Entries without a recorded version are considered older than any version.
+func (s *FSStore) KeysOlderThanVersion(version string) ([]CacheKey, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var older []CacheKey
+	for _, key := range keys {
+		meta, err := s.ReadMeta(key)
+		if err != nil {
+			return nil, err
+		}
+		if compareVersions(meta.CachenvVersion, version) < 0 {
+			older = append(older, key)
+		}
+	}
+	return older, nil
+}
+
+// Returns the keys of entries created more than age ago. The creation time
+// comes from the entry's metadata, falling back to the mtime of its output
+// for entries without one.
+func (s *FSStore) KeysOlderThan(age time.Duration) ([]CacheKey, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var older []CacheKey
+	for _, key := range keys {
+		meta, err := s.ReadMeta(key)
+		if err != nil {
+			return nil, err
+		}
+		entryAge := time.Since(meta.Created)
+		if meta.Created.IsZero() {
+			if entryAge, err = s.Age(key); err != nil {
+				return nil, err
+			}
+		}
+		if entryAge > age {
+			older = append(older, key)
+		}
+	}
+	return older, nil
+}
+
+// Returns the keys of the least recently used entries which must be removed
+// to leave at most max entries, not counting those in excluding (e.g. ones
+// already due to be removed). A max of zero selects every entry.
+func (s *FSStore) KeysBeyondMax(max int, excluding []CacheKey) ([]CacheKey, error) {
+	lru, err := s.LoadLRU()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range excluding {
+		lru.Remove(key.Hash)
+	}
+
+	// An LRUCache treats a Capacity of zero as unbounded
+	var hashes []string
+	if max <= 0 {
+		hashes = lru.Hashes()
+	} else {
+		lru.Capacity = max
+		hashes = lru.Trim()
+	}
+
+	var keys []CacheKey
+	for _, hash := range hashes {
+		keys = append(keys, CacheKey{Hash: hash})
+	}
+	return keys, nil
+}
+
+// Returns the keys of entries recorded as invocations of command. Entries
+// without metadata never match.
+func (s *FSStore) KeysForCommand(command string) ([]CacheKey, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []CacheKey
+	for _, key := range keys {
+		meta, err := s.ReadMeta(key)
+		if err != nil {
+			return nil, err
+		}
+		if meta.Command == command {
+			matching = append(matching, key)
+		}
+	}
+	return matching, nil
+}
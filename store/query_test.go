@@ -0,0 +1,65 @@
+package store
+
+import "testing"
+
+func TestKeysBeyondMax(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	for _, name := range []string{"a", "b", "c"} {
+		writeTestEntry(t, s, testKey(name))
+	}
+
+	for max, expected := range map[int]int{0: 3, 1: 2, 3: 0, 5: 0} {
+		keys, err := s.KeysBeyondMax(max, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != expected {
+			t.Errorf("max %d: expected %d keys, got %d", max, expected, len(keys))
+		}
+	}
+
+	keys, err := s.KeysBeyondMax(0, []CacheKey{testKey("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("expected excluded key to be skipped, got %d keys", len(keys))
+	}
+}
+
+func TestKeysOlderThanVersion(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	defer func(version string) { Version = version }(Version)
+
+	written := map[string]string{"a": "0.9.0", "b": "0.10.0", "c": "1.0.0"}
+	for name, version := range written {
+		Version = version
+		key := testKey(name)
+		key.Command = "echo"
+		writeTestEntry(t, s, key)
+
+		meta, err := s.ReadMeta(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.CachenvVersion != version {
+			t.Errorf("entry %s records version %q, expected %q", name, meta.CachenvVersion, version)
+		}
+	}
+	// Without metadata, an entry's version is unknown, and so older than any
+	writeTestEntry(t, s, testKey("d"))
+
+	keys, err := s.KeysOlderThanVersion("0.10.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := make(map[string]bool)
+	for _, key := range keys {
+		selected[key.Hash] = true
+	}
+	for name, expected := range map[string]bool{"a": true, "b": false, "c": false, "d": true} {
+		if selected[testKey(name).Hash] != expected {
+			t.Errorf("entry %s selected = %v, expected %v", name, !expected, expected)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* Remote storage */
+
+// How long requests to a remote cache may take, unless configured
+const DEFAULT_REMOTE_TIMEOUT = 10 * time.Second
+
+// Client for a remote object store holding each entry as the objects
+// <hash>/out, <hash>/err, <hash>/status and, with output files, <hash>/files
+type objectClient interface {
+	// Returns the object's last-modified time, or an error matching
+	// os.ErrNotExist if there is no such object
+	head(name string) (time.Time, error)
+
+	get(name string) ([]byte, error)
+	put(name string, data []byte) error
+}
+
+// Store over an objectClient, layered over the local store: writes go to both,
+// and with read-through, reads try the local store first and copy remote hits
+// into it. Remote failures never fail the command; a failed lookup is a miss
+// and a failed write only warns.
+type remoteStore struct {
+	Local       *FSStore
+	ReadThrough bool
+
+	objects objectClient
+	warn    sync.Once
+}
+
+func newRemoteStore(config RemoteConfig, local *FSStore, objects objectClient) remoteStore {
+	return remoteStore{
+		Local:       local,
+		ReadThrough: config.ReadThroughEnabled(),
+		objects:     objects,
+	}
+}
+
+// Reports a remote failure, once per invocation so that an unreachable server
+// doesn't produce a warning per request
+func (s *remoteStore) warnUnavailable(err error) {
+	s.warn.Do(func() {
+		fmt.Fprintf(os.Stderr, "Warning: remote cache unavailable: %v\n", err)
+	})
+}
+
+func (s *remoteStore) Exists(key CacheKey) bool {
+	if s.ReadThrough && s.Local.Exists(key) {
+		return true
+	}
+	_, err := s.objects.head(key.Hash + "/status")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.warnUnavailable(err)
+	}
+	return err == nil
+}
+
+func (s *remoteStore) Age(key CacheKey) (time.Duration, error) {
+	if s.ReadThrough && s.Local.Exists(key) {
+		return s.Local.Age(key)
+	}
+	modified, err := s.objects.head(key.Hash + "/status")
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(modified), nil
+}
+
+func (s *remoteStore) ReadFromCache(key CacheKey) (ExecResult, error) {
+	if s.ReadThrough && s.Local.Exists(key) {
+		return s.Local.ReadFromCache(key)
+	}
+
+	var result ExecResult
+	var err error
+	if result.Stdout, err = s.objects.get(key.Hash + "/out"); err != nil {
+		return result, err
+	}
+	if result.Stderr, err = s.objects.get(key.Hash + "/err"); err != nil {
+		return result, err
+	}
+	status, err := s.objects.get(key.Hash + "/status")
+	if err != nil {
+		return result, err
+	}
+	result.ExitCode, err = strconv.Atoi(string(status))
+	if err != nil || result.ExitCode < 0 || result.ExitCode > 255 {
+		return result, fmt.Errorf("%w %q for %s", ErrInvalidStatus, status, key.Hash)
+	}
+	// Only entries of commands with output_files have files
+	if files, err := s.objects.get(key.Hash + "/files"); err == nil {
+		if result.Files, err = decodeFiles(files); err != nil {
+			return result, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return result, err
+	}
+
+	if s.ReadThrough {
+		if err := s.Local.WriteToCache(key, result); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to copy remote entry locally: %v\n", err)
+		}
+	}
+	return result, nil
+}
+
+// Writes the entry locally and then remotely. The remote status object is
+// written last, so that other readers never see a partial entry.
+func (s *remoteStore) WriteToCache(key CacheKey, result ExecResult) error {
+	if err := s.Local.WriteToCache(key, result); err != nil {
+		return err
+	}
+	type object struct {
+		name string
+		data []byte
+	}
+	objects := []object{
+		{"out", result.Stdout},
+		{"err", result.Stderr},
+	}
+	if result.Files != nil {
+		files, err := encodeFiles(result.Files)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, object{"files", files})
+	}
+	objects = append(objects, object{"status", []byte(fmt.Sprint(result.ExitCode))})
+	for _, object := range objects {
+		if err := s.objects.put(key.Hash+"/"+object.name, object.data); err != nil {
+			s.warnUnavailable(err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Bookkeeping is kept in the local store. Only its copy of an entry's exit
+// code and metadata is read, so as not to fetch the entry twice.
+
+func (s *remoteStore) ReadExitCode(key CacheKey) (int, error) {
+	return s.Local.ReadExitCode(key)
+}
+
+func (s *remoteStore) ReadMeta(key CacheKey) (EntryMeta, error) {
+	return s.Local.ReadMeta(key)
+}
+
+func (s *remoteStore) Lock(key CacheKey) (func(), error) {
+	return s.Local.Lock(key)
+}
+
+func (s *remoteStore) MarkUsed(key CacheKey) error {
+	return s.Local.MarkUsed(key)
+}
+
+func (s *remoteStore) RecordHit() error {
+	return s.Local.RecordHit()
+}
+
+func (s *remoteStore) RecordMiss() error {
+	return s.Local.RecordMiss()
+}
+
+func (s *remoteStore) LogInvocation(path string, maxBytes int64, inv Invocation) error {
+	return s.Local.LogInvocation(path, maxBytes, inv)
+}
+
+func (s *remoteStore) WriteMetrics(dir, cachenvDir string) error {
+	return s.Local.WriteMetrics(dir, cachenvDir)
+}
+
+// Returns resp if it's a success; otherwise closes it and returns an error,
+// matching os.ErrNotExist for a 404. url identifies the object in errors.
+func checkResponse(resp *http.Response, url string) (*http.Response, error) {
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", url, os.ErrNotExist)
+	}
+	return nil, fmt.Errorf("%s %s: %s", resp.Request.Method, url, resp.Status)
+}
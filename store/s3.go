@@ -0,0 +1,459 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* S3 remote storage */
+
+// Name of the file in FSStore.Dir whose presence records that the EC2
+// metadata endpoint was unreachable, so that invocations off EC2 don't each
+// wait for it to time out
+const NO_IMDS_NAME = "no-imds"
+
+// How long the EC2 metadata endpoint is assumed to stay unreachable
+const NO_IMDS_TTL = time.Hour
+
+// Store which keeps entries in an S3 bucket, as the objects
+// <prefix><hash>/{out,err,status}, layered over the local store
+type S3Store struct {
+	remoteStore
+
+	Bucket   string
+	Region   string
+	Prefix   string
+	Endpoint string
+
+	client *http.Client
+	creds  awsCredentials
+}
+
+func NewS3Store(config RemoteConfig, local *FSStore) *S3Store {
+	region := config.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	s := &S3Store{
+		Bucket:   config.Bucket,
+		Region:   region,
+		Prefix:   config.Prefix,
+		Endpoint: strings.TrimSuffix(config.Endpoint, "/"),
+		client:   &http.Client{Timeout: config.TimeoutOrDefault()},
+	}
+	if local != nil {
+		s.creds.noIMDSPath = filepath.Join(local.Dir, NO_IMDS_NAME)
+	}
+	s.remoteStore = newRemoteStore(config, local, s)
+	return s
+}
+
+func (s *S3Store) KeyDir(key CacheKey) string {
+	return fmt.Sprintf("s3://%s/%s%s", s.Bucket, s.Prefix, key.Hash)
+}
+
+func (s *S3Store) objectURL(name string) string {
+	objectKey := awsURIEncode(s.Prefix+name, false)
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + s.Bucket + "/" + objectKey
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, objectKey)
+}
+
+func (s *S3Store) head(name string) (time.Time, error) {
+	resp, err := s.do(http.MethodHead, name, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+func (s *S3Store) get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *S3Store) put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Sends a signed request for an object, failing unless the response is a
+// success. A missing object yields an error matching os.ErrNotExist.
+func (s *S3Store) do(method, name string, body []byte) (*http.Response, error) {
+	creds, err := s.creds.get(s.client)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, s.objectURL(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signAWSRequest(req, body, creds, s.Region, "s3", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return checkResponse(resp, fmt.Sprintf("s3://%s/%s%s", s.Bucket, s.Prefix, name))
+}
+
+/* AWS request signing (Signature Version 4) */
+
+type awsCredentialValues struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// Resolves credentials from the standard sources, in order: environment
+// variables, the shared credentials file, the ECS container role, and the EC2
+// instance role. Temporary credentials are cached until shortly before they
+// expire, and finding none is cached for the rest of the invocation.
+type awsCredentials struct {
+	mu     sync.Mutex
+	cached *awsCredentialValues
+	err    error
+
+	// Where to record that the EC2 metadata endpoint is unreachable, if
+	// anywhere
+	noIMDSPath string
+}
+
+func (a *awsCredentials) get(client *http.Client) (awsCredentialValues, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return awsCredentialValues{}, a.err
+	}
+	if a.cached != nil && (a.cached.Expiration.IsZero() || time.Until(a.cached.Expiration) > time.Minute) {
+		return *a.cached, nil
+	}
+
+	sources := []func(*http.Client) (*awsCredentialValues, error){
+		awsEnvCredentials,
+		awsSharedCredentials,
+		awsContainerCredentials,
+		a.instanceCredentials,
+	}
+	for _, source := range sources {
+		creds, err := source(client)
+		if err != nil {
+			return awsCredentialValues{}, err
+		}
+		if creds != nil {
+			a.cached = creds
+			return *creds, nil
+		}
+	}
+	a.err = fmt.Errorf("no AWS credentials found")
+	return awsCredentialValues{}, a.err
+}
+
+// Like awsInstanceCredentials, but skips the metadata endpoint if an earlier
+// invocation found it unreachable within NO_IMDS_TTL
+func (a *awsCredentials) instanceCredentials(client *http.Client) (*awsCredentialValues, error) {
+	if a.noIMDSPath == "" {
+		return awsInstanceCredentials(client)
+	}
+	if info, err := os.Stat(a.noIMDSPath); err == nil && time.Since(info.ModTime()) < NO_IMDS_TTL {
+		return nil, nil
+	}
+	creds, err := awsInstanceCredentials(client)
+	if err == nil && creds == nil {
+		// Failing to record this only costs the next invocation a timeout
+		os.WriteFile(a.noIMDSPath, nil, 0o644)
+	} else if creds != nil {
+		os.Remove(a.noIMDSPath)
+	}
+	return creds, err
+}
+
+func awsEnvCredentials(*http.Client) (*awsCredentialValues, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil, nil
+	}
+	return &awsCredentialValues{
+		AccessKeyID:     id,
+		SecretAccessKey: secret,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+func awsSharedCredentials(*http.Client) (*awsCredentialValues, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read AWS credentials: %w", err)
+	}
+	defer f.Close()
+
+	var creds awsCredentialValues
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read AWS credentials: %w", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// Credentials as served by the ECS and EC2 metadata endpoints
+type awsMetadataCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func fetchAWSMetadataCredentials(client *http.Client, req *http.Request) (*awsCredentialValues, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch AWS credentials: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch AWS credentials: %s", resp.Status)
+	}
+	var creds awsMetadataCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("failed to decode AWS credentials: %w", err)
+	}
+	return &awsCredentialValues{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expiration:      creds.Expiration,
+	}, nil
+}
+
+func awsContainerCredentials(client *http.Client) (*awsCredentialValues, error) {
+	uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	if uri == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.170.2"+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetchAWSMetadataCredentials(client, req)
+}
+
+// Fetches the instance role's credentials via IMDSv2. Not running on EC2 (so
+// the endpoint is unreachable) isn't an error; there are just no credentials.
+func awsInstanceCredentials(*http.Client) (*awsCredentialValues, error) {
+	const imds = "http://169.254.169.254/latest"
+	client := &http.Client{Timeout: time.Second}
+
+	req, err := http.NewRequest(http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil
+	}
+	token, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, imds+path, nil)
+		if err == nil {
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		}
+		return req, err
+	}
+	req, err = get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, nil
+	}
+	role, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	req, err = get("/meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)))
+	if err != nil {
+		return nil, err
+	}
+	return fetchAWSMetadataCredentials(client, req)
+}
+
+// Encodes s as SigV4 requires: everything but unreserved characters is
+// percent-encoded, and '/' too unless encodeSlash is false
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Encodes query as SigV4 requires: parameters sorted by name then value, and
+// each written as name=value even if the value is empty
+func awsCanonicalQuery(query url.Values) string {
+	var params [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{awsURIEncode(name, true), awsURIEncode(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Adds SigV4 authentication headers to req, whose body is body
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentialValues, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
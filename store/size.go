@@ -0,0 +1,195 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/* Disk usage */
+
+// Attributed to entries written without metadata
+const UNKNOWN_COMMAND = "(unknown)"
+
+type EntrySize struct {
+	Hash        string `json:"hash"`
+	Command     string `json:"command"`
+	CommandLine string `json:"command_line"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// Returns the size of every entry in the store, largest first. As with
+// EntrySize, outputs shared between entries count toward each of them, so
+// these don't add up to the space the store takes; see DiskUsage for that.
+func (s *FSStore) EntrySizes() ([]EntrySize, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make([]EntrySize, 0, len(keys))
+	for _, key := range keys {
+		bytes, err := s.EntrySize(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to size entry %s: %w", key.Hash, err)
+		}
+		meta, err := s.ReadMeta(key)
+		if err != nil {
+			return nil, err
+		}
+		command := meta.Command
+		if command == "" {
+			command = UNKNOWN_COMMAND
+		}
+		sizes = append(sizes, EntrySize{
+			Hash:        key.Hash,
+			Command:     command,
+			CommandLine: meta.CommandLine(),
+			Bytes:       bytes,
+		})
+	}
+
+	sort.SliceStable(sizes, func(i, j int) bool {
+		if sizes[i].Bytes != sizes[j].Bytes {
+			return sizes[i].Bytes > sizes[j].Bytes
+		}
+		return sizes[i].Hash < sizes[j].Hash
+	})
+	return sizes, nil
+}
+
+// Identifies a file on disk, e.g. by device and inode
+type fileKey struct {
+	dev, ino uint64
+}
+
+// The space the store takes on disk
+type DiskUsage struct {
+	Entries int `json:"entries"`
+
+	// Everything in the entries and the blobs directory, counting each
+	// file once however many entries link to it
+	Bytes int64 `json:"bytes"`
+
+	// The blobs directory alone, i.e. deduplicated outputs
+	BlobBytes int64 `json:"blob_bytes"`
+
+	// Blobs no entry links to, which 'cachenv gc' would free
+	UnreferencedBytes int64 `json:"unreferenced_bytes"`
+}
+
+// Counts the space the store takes on disk. Unlike summing EntrySize, this
+// counts an output shared between entries once, and includes blobs no entry
+// uses anymore.
+func (s *FSStore) DiskUsage() (DiskUsage, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return DiskUsage{}, err
+	}
+
+	usage := DiskUsage{Entries: len(keys)}
+	seen := make(map[fileKey]bool)
+	for _, key := range keys {
+		err := filepath.WalkDir(s.KeyDir(key), func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if id, ok := fileID(path, info); ok {
+				if seen[id] {
+					return nil
+				}
+				seen[id] = true
+			}
+			usage.Bytes += info.Size()
+			return nil
+		})
+		if err != nil {
+			return DiskUsage{}, fmt.Errorf("failed to size entry %s: %w", key.Hash, err)
+		}
+	}
+
+	blobs, err := os.ReadDir(s.blobsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return DiskUsage{}, fmt.Errorf("failed to read blobs directory: %w", err)
+	}
+	for _, blob := range blobs {
+		info, err := blob.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(s.blobsDir(), blob.Name())
+		usage.BlobBytes += info.Size()
+		if id, ok := fileID(path, info); ok && seen[id] {
+			continue
+		}
+		usage.Bytes += info.Size()
+		if links, ok := linkCount(path, info); ok && links == 1 {
+			usage.UnreferencedBytes += info.Size()
+		}
+	}
+	return usage, nil
+}
+
+// Returns the number of bytes removing the entries with keys would free on
+// disk: their files, and the blobs they link to, which no other entry uses
+func (s *FSStore) FreedBy(keys []CacheKey) (int64, error) {
+	type file struct {
+		size  int64
+		links uint64
+		seen  uint64
+	}
+	files := make(map[fileKey]*file)
+	var freed int64
+	for _, key := range keys {
+		err := filepath.WalkDir(s.KeyDir(key), func(path string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			id, ok := fileID(path, info)
+			links, linksOK := linkCount(path, info)
+			if !ok || !linksOK {
+				freed += info.Size()
+				return nil
+			}
+			if f, ok := files[id]; ok {
+				f.seen++
+			} else {
+				files[id] = &file{size: info.Size(), links: links, seen: 1}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to size entry %s: %w", key.Hash, err)
+		}
+	}
+
+	// The remaining link to a file may be its blob, which is freed too
+	blobs := make(map[fileKey]bool)
+	names, err := os.ReadDir(s.blobsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read blobs directory: %w", err)
+	}
+	for _, name := range names {
+		path := filepath.Join(s.blobsDir(), name.Name())
+		if info, err := name.Info(); err == nil {
+			if id, ok := fileID(path, info); ok {
+				blobs[id] = true
+			}
+		}
+	}
+	for id, f := range files {
+		if f.seen == f.links || (f.seen+1 == f.links && blobs[id]) {
+			freed += f.size
+		}
+	}
+	return freed, nil
+}
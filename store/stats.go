@@ -0,0 +1,71 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* Hit/miss statistics */
+
+// Name of the file in FSStore.Dir holding cumulative hit/miss counts
+const STATS_NAME = "stats"
+
+type Stats struct {
+	Hits   int64 `yaml:"hits"`
+	Misses int64 `yaml:"misses"`
+}
+
+// Percentage of lookups which were hits, or 0 if there were none
+func (st Stats) HitRate() float64 {
+	total := st.Hits + st.Misses
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(st.Hits) / float64(total)
+}
+
+func (s *FSStore) statsPath() string {
+	return filepath.Join(s.Dir, STATS_NAME)
+}
+
+func (s *FSStore) ReadStats() (Stats, error) {
+	var stats Stats
+	data, err := os.ReadFile(s.statsPath())
+	if os.IsNotExist(err) {
+		return stats, nil
+	} else if err != nil {
+		return stats, err
+	}
+	if err := yaml.Unmarshal(data, &stats); err != nil {
+		return stats, fmt.Errorf("failed to decode stats: %w", err)
+	}
+	return stats, nil
+}
+
+// Applies update to the persisted stats while holding the store lock, so
+// concurrent invocations don't lose counts
+func (s *FSStore) updateStats(update func(*Stats)) error {
+	return s.withLock(func() error {
+		stats, err := s.ReadStats()
+		if err != nil {
+			return err
+		}
+		update(&stats)
+		data, err := yaml.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(s.statsPath(), data, 0644)
+	})
+}
+
+func (s *FSStore) RecordHit() error {
+	return s.updateStats(func(stats *Stats) { stats.Hits++ })
+}
+
+func (s *FSStore) RecordMiss() error {
+	return s.updateStats(func(stats *Stats) { stats.Misses++ })
+}
@@ -0,0 +1,650 @@
+package store
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* Storage */
+
+// Version of the encoding hashed to produce cache keys. Bump this whenever the
+// encoding changes, so that existing entries miss rather than being returned
+// for the wrong invocation.
+const KEY_VERSION = 2
+
+// Prefix of the temporary directories in which entries are staged
+const STAGING_PREFIX = ".staging-"
+
+// Staging directories older than this are assumed to have been left behind by
+// an interrupted write, and are removed by GCStaging
+const STAGING_MAX_AGE = time.Hour
+
+// Result of running a command
+type ExecResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+
+	// Whether capture stopped because the output exceeded a size limit,
+	// leaving Stdout and Stderr incomplete
+	Truncated bool
+
+	// Whether the command was killed for exceeding its timeout
+	TimedOut bool
+
+	// Whether we relayed a signal (e.g. SIGINT) to the command, so that its
+	// output may be incomplete
+	Interrupted bool
+
+	// Whether the command was killed by a signal (e.g. by the OOM killer).
+	// ExitCode is then 128 plus the signal number.
+	Signaled bool
+
+	// Files the command wrote, for commands with output_files. Nil if none
+	// were captured.
+	Files []OutputFile
+
+	// How long the command ran, if known. Recorded in the entry's metadata.
+	Duration time.Duration
+}
+
+// Reports whether the result is the command's full output, and so may be
+// cached
+func (r ExecResult) Complete() bool {
+	return !r.Truncated && !r.TimedOut && !r.Interrupted && !r.Signaled
+}
+
+// Backend which cache entries are stored in, and which keeps the bookkeeping
+// done on each invocation of a memoized command
+type Store interface {
+	// Reports whether a complete entry exists for key
+	Exists(key CacheKey) bool
+
+	// Returns the time since the entry for key was written
+	Age(key CacheKey) (time.Duration, error)
+
+	ReadFromCache(key CacheKey) (ExecResult, error)
+	WriteToCache(key CacheKey, result ExecResult) error
+
+	// Returns where the entry for key is stored, for display
+	KeyDir(key CacheKey) string
+
+	// Returns just the exit code of the entry for key, failing if it can't
+	// be read without fetching the whole entry
+	ReadExitCode(key CacheKey) (int, error)
+
+	// Returns the metadata of the entry for key, which is empty if none was
+	// recorded
+	ReadMeta(key CacheKey) (EntryMeta, error)
+
+	// Acquires an exclusive lock on the entry for key, blocking while
+	// another invocation holds it. The returned function releases the lock.
+	Lock(key CacheKey) (func(), error)
+
+	// Records a use of the entry for key, for evicting the least recently
+	// used entries
+	MarkUsed(key CacheKey) error
+
+	RecordHit() error
+	RecordMiss() error
+
+	// Appends inv to the invocation log at path, rotating it beyond maxBytes
+	LogInvocation(path string, maxBytes int64, inv Invocation) error
+
+	// Writes Prometheus metrics for the cachenv in cachenvDir to dir
+	WriteMetrics(dir, cachenvDir string) error
+}
+
+// Reports whether a complete entry exists for key in s and is no older than
+// ttl. A zero ttl never expires.
+func Fresh(s Store, key CacheKey, ttl time.Duration) bool {
+	if !s.Exists(key) {
+		return false
+	}
+	if ttl == 0 {
+		return true
+	}
+	age, err := s.Age(key)
+	return err == nil && age <= ttl
+}
+
+// Store which keeps each entry in a directory under Dir
+type FSStore struct {
+	Dir string
+
+	// Whether to gzip stdout/stderr when writing entries
+	Compress bool
+
+	// Whether entries are written readable only by their owner
+	Private bool
+
+	// Number of entries beyond which the least recently used are evicted.
+	// Zero means unbounded, in which case uses aren't tracked and pruning to
+	// a maximum removes the oldest entries first.
+	MaxEntries int
+}
+
+type CacheKey struct {
+	Hash string
+
+	// The invocation the key was computed from, if known. Recorded in the
+	// entry's metadata so the one-way hash can be traced back to a command.
+	Command string
+	Args    []string
+}
+
+// Metadata stored alongside each cache entry
+type EntryMeta struct {
+	// Args which aren't valid UTF-8 (e.g. filenames in another encoding) are
+	// stored base64-encoded, tagged !!binary, and decoded back to the same
+	// bytes
+	Command string    `yaml:"command"`
+	Args    []string  `yaml:"args"`
+	Created time.Time `yaml:"created"`
+
+	// Version of cachenv which wrote the entry
+	CachenvVersion string `yaml:"cachenv_version"`
+
+	// How long the command ran, i.e. roughly the time each hit saves. Zero
+	// if unknown.
+	Duration time.Duration `yaml:"duration,omitempty"`
+}
+
+// Returns the recorded invocation as a single line, or "" if unknown. Args
+// which aren't printable UTF-8 are quoted as bash would, e.g. $'caf\xe9'.
+func (m EntryMeta) CommandLine() string {
+	words := []string{m.Command}
+	for _, arg := range m.Args {
+		words = append(words, displayArg(arg))
+	}
+	return strings.TrimSpace(strings.Join(words, " "))
+}
+
+func isDisplayable(r rune) bool {
+	return r == ' ' || unicode.IsPrint(r)
+}
+
+// Returns arg as is if it's printable UTF-8, otherwise in bash's $'...' form
+func displayArg(arg string) string {
+	if utf8.ValidString(arg) && strings.IndexFunc(arg, func(r rune) bool { return !isDisplayable(r) }) < 0 {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(arg); {
+		r, size := utf8.DecodeRuneInString(arg[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, arg[i])
+		case r == '\'' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case !isDisplayable(r):
+			for _, c := range []byte(arg[i : i+size]) {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			}
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+// Inputs other than the command and its arguments which distinguish cache
+// entries. Zero values don't contribute to the key.
+type KeyInputs struct {
+	// Data the command reads from stdin
+	Stdin []byte
+
+	// Working directory the command runs in
+	Cwd string
+
+	// Fingerprint of the command's executable, so that entries miss once it
+	// changes (e.g. is upgraded)
+	Binary string
+
+	// Fingerprints of files the command reads, e.g. "data.json:<sha256>"
+	Files []string
+}
+
+func KeyFrom(command string, args []string) CacheKey {
+	return KeyFromInputs(command, args, KeyInputs{})
+}
+
+// Like KeyFrom, but also keys on the provided inputs. Zero inputs yield the
+// same key as KeyFrom.
+func KeyFromInputs(command string, args []string, inputs KeyInputs) CacheKey {
+	return HashConfig{}.KeyFromInputs(command, args, inputs)
+}
+
+// Like the package-level KeyFrom, but hashes as configured
+func (h HashConfig) KeyFrom(command string, args []string) CacheKey {
+	return h.KeyFromInputs(command, args, KeyInputs{})
+}
+
+// Like the package-level KeyFromInputs, but hashes as configured. h must be
+// valid (see Validate).
+func (h HashConfig) KeyFromInputs(command string, args []string, inputs KeyInputs) CacheKey {
+	// The hashed data is a list of NUL-separated fields: the key version, any
+	// inputs as name=value, an empty field, then the command and each arg.
+	// None of these can contain NUL, so distinct invocations never collide;
+	// in particular, each arg adds its own separator, so no args, one
+	// empty arg and two empty args are all distinct.
+	// A non-default hash is part of the version, so that changing it never
+	// yields keys of entries written with another.
+	version := fmt.Sprintf("v%d", KEY_VERSION)
+	if h.algo() != HASH_SHA256 || h.length() != sha256.Size {
+		version += fmt.Sprintf("-%s-%d", h.algo(), h.length())
+	}
+	fields := []string{version}
+	if inputs.Stdin != nil {
+		fields = append(fields, fmt.Sprintf("stdin=%x", sha256.Sum256(inputs.Stdin)))
+	}
+	if inputs.Cwd != "" {
+		fields = append(fields, "cwd="+inputs.Cwd)
+	}
+	if inputs.Binary != "" {
+		fields = append(fields, "binary="+inputs.Binary)
+	}
+	for _, file := range inputs.Files {
+		fields = append(fields, "file="+file)
+	}
+	fields = append(fields, "", command)
+	fields = append(fields, args...)
+
+	return CacheKey{
+		Hash:    fmt.Sprintf("%x", h.sum([]byte(strings.Join(fields, "\x00")))),
+		Command: command,
+		Args:    args,
+	}
+}
+
+func (s *FSStore) stdoutPath(key CacheKey) string {
+	return filepath.Join(s.KeyDir(key), "out")
+}
+
+func (s *FSStore) stderrPath(key CacheKey) string {
+	return filepath.Join(s.KeyDir(key), "err")
+}
+
+func (s *FSStore) exitcodePath(key CacheKey) string {
+	return filepath.Join(s.KeyDir(key), "status")
+}
+
+func (s *FSStore) metaPath(key CacheKey) string {
+	return filepath.Join(s.KeyDir(key), "meta")
+}
+
+// Reports whether a complete entry exists for key. The status file is checked
+// rather than the directory, which may exist before the entry is written (e.g.
+// while locked). An entry which can't be read (e.g. under a path blocked by a
+// file) doesn't count.
+func (s *FSStore) Exists(key CacheKey) bool {
+	_, err := os.Stat(s.exitcodePath(key))
+	return err == nil
+}
+
+// Returns the time since the entry was written, based on the mtime of its
+// status file. (Output files may be links to a blob written long before.)
+func (s *FSStore) Age(key CacheKey) (time.Duration, error) {
+	info, err := os.Stat(s.exitcodePath(key))
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(info.ModTime()), nil
+}
+
+// Writes the entry for key. The files are staged in a temporary directory,
+// which is then renamed into place as a whole, so that an interrupted write
+// never leaves behind an entry that Exists considers complete, and readers
+// never see a mix of an old entry's files and a new one's.
+func (s *FSStore) WriteToCache(key CacheKey, result ExecResult) error {
+	meta, err := s.encodeMeta(key, result.Duration)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.Dir, s.DirMode()); err != nil {
+		return err
+	}
+	stagingDir, err := os.MkdirTemp(s.Dir, STAGING_PREFIX)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := os.Chmod(stagingDir, s.DirMode()); err != nil {
+		return err
+	}
+
+	type file struct {
+		path string
+		data []byte
+
+		// Whether to store the data content-addressed, so identical outputs
+		// share a blob
+		blob bool
+	}
+	files := []file{
+		{s.stdoutPath(key), result.Stdout, true},
+		{s.stderrPath(key), result.Stderr, true},
+	}
+	if result.Files != nil {
+		encoded, err := encodeFiles(result.Files)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{s.filesPath(key), encoded, true})
+	}
+	if s.Compress {
+		for i := range files {
+			if files[i].data, err = gzipBytes(files[i].data); err != nil {
+				return err
+			}
+			files[i].path += GZIP_EXT
+		}
+	}
+	if meta != nil {
+		files = append(files, file{s.metaPath(key), meta, false})
+	}
+	files = append(files, file{s.exitcodePath(key), []byte(fmt.Sprint(result.ExitCode)), false})
+
+	// Track the space this takes on disk, and frees by replacing an existing
+	// entry, to keep the cached usage current
+	var written int64
+	for _, f := range files {
+		staged := filepath.Join(stagingDir, filepath.Base(f.path))
+		var n int64
+		if f.blob {
+			n, err = s.writeBlobLink(staged, f.data)
+		} else {
+			n, err = int64(len(f.data)), os.WriteFile(staged, f.data, s.FileMode())
+		}
+		written += n
+		if err != nil {
+			return err
+		}
+	}
+
+	existed := s.Exists(key)
+	freed, err := s.swapIn(stagingDir, s.KeyDir(key))
+	if err != nil {
+		return err
+	}
+
+	var added int64
+	if !existed {
+		added = 1
+	}
+	if err := s.addUsage(added, written-freed); err != nil {
+		return err
+	}
+	return s.markWritten(key)
+}
+
+// Moves the staged entry directory into place at dir with a single rename,
+// first moving aside (and then removing) any entry already there. Readers
+// may briefly find no entry, but never a partial one. Returns the number of
+// bytes freed by removing the old entry.
+func (s *FSStore) swapIn(staged, dir string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), s.DirMode()); err != nil {
+		return 0, err
+	}
+	// Named like a staging directory, so that gc removes it if we're
+	// interrupted before we do
+	old := staged + ".old"
+
+	// Another write may land between moving the old entry aside and renaming
+	// ours into place; the last write wins
+	var freed int64
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+			return freed, err
+		}
+		if err = os.Rename(staged, dir); !os.IsExist(err) {
+			break
+		}
+		n, err := s.discard(old)
+		freed += n
+		if err != nil {
+			return freed, err
+		}
+	}
+	n, discardErr := s.discard(old)
+	freed += n
+	if err != nil {
+		return freed, err
+	}
+	return freed, discardErr
+}
+
+// Moves dir, a complete entry written elsewhere (e.g. extracted from an
+// archive), into place as the entry for key, as WriteToCache would. An
+// existing entry is only replaced if overwrite is set. Returns whether dir was
+// moved.
+func (s *FSStore) Adopt(key CacheKey, dir string, overwrite bool) (bool, error) {
+	unlock, err := s.Lock(key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if s.Exists(key) && !overwrite {
+		return false, nil
+	}
+	if _, err := s.swapIn(dir, s.KeyDir(key)); err != nil {
+		return false, fmt.Errorf("failed to move entry %s into place: %w", key.Hash, err)
+	}
+	s.InvalidateUsage()
+	return true, s.markWritten(key)
+}
+
+// Removes an entry directory moved aside by swapIn, freeing its blobs as
+// Remove does
+func (s *FSStore) discard(dir string) (int64, error) {
+	var freed int64
+	err := s.withLock(func() error {
+		var err error
+		freed, err = s.removeFreeing(dir)
+		return err
+	})
+	return freed, err
+}
+
+// Returns the encoded metadata for key, or nil if the key doesn't record its
+// invocation
+func (s *FSStore) encodeMeta(key CacheKey, duration time.Duration) ([]byte, error) {
+	if key.Command == "" {
+		return nil, nil
+	}
+	return yaml.Marshal(EntryMeta{
+		Command:        key.Command,
+		Args:           key.Args,
+		Created:        time.Now().UTC(),
+		CachenvVersion: Version,
+		Duration:       duration,
+	})
+}
+
+// Marks an existing entry as just written, without changing its contents:
+// bumps the mtime of its files and its recorded creation time, and marks it
+// used. This resets its age for TTL and pruning purposes.
+func (s *FSStore) Touch(key CacheKey) error {
+	now := time.Now()
+	files, err := os.ReadDir(s.KeyDir(key))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Chtimes(filepath.Join(s.KeyDir(key), file.Name()), now, now); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(s.metaPath(key)); err == nil {
+		meta, err := s.ReadMeta(key)
+		if err != nil {
+			return err
+		}
+		meta.Created = now.UTC()
+		data, err := yaml.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		// Replace the file atomically, so readers never see partial metadata
+		f, err := os.CreateTemp(s.KeyDir(key), ".meta-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Chmod(s.FileMode()); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), s.metaPath(key)); err != nil {
+			return err
+		}
+	}
+
+	return s.MarkUsed(key)
+}
+
+// Returns the metadata for the entry. Entries written without metadata yield a
+// zero EntryMeta rather than an error.
+func (s *FSStore) ReadMeta(key CacheKey) (EntryMeta, error) {
+	var meta EntryMeta
+	data, err := os.ReadFile(s.metaPath(key))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, err
+	}
+	if err := yaml.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("failed to decode metadata for %s: %w", key.Hash, err)
+	}
+	return meta, nil
+}
+
+// Deletes the entry for key, and any output blobs only it used. Its lock
+// file is kept, as another process may hold it while refreshing the entry;
+// see GCLocks.
+func (s *FSStore) Remove(key CacheKey) error {
+	_, err := s.RemoveFreeing(key)
+	return err
+}
+
+// Like Remove, but also returns the number of bytes this freed on disk, which
+// excludes outputs still shared with other entries
+func (s *FSStore) RemoveFreeing(key CacheKey) (int64, error) {
+	var freed int64
+	err := s.withLock(func() error {
+		var err error
+		freed, err = s.remove(key)
+		return err
+	})
+	return freed, err
+}
+
+// Removes the entry for key as RemoveFreeing does. The caller holds the store
+// lock.
+func (s *FSStore) remove(key CacheKey) (int64, error) {
+	freed, err := s.removeFreeing(s.KeyDir(key))
+	if err != nil {
+		return freed, fmt.Errorf("failed to remove entry %s: %w", key.Hash, err)
+	}
+	s.InvalidateUsage()
+	return freed, nil
+}
+
+// Returns the total size in bytes of the files making up the entry. Outputs
+// it shares with other entries count in full, so this is more than removing
+// it would free.
+func (s *FSStore) EntrySize(key CacheKey) (int64, error) {
+	files, err := os.ReadDir(s.KeyDir(key))
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			return 0, err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// Returned when an entry's status file doesn't hold a valid exit code
+var ErrInvalidStatus = errors.New("invalid status")
+
+// Reads just the exit code of the entry
+func (s *FSStore) ReadExitCode(key CacheKey) (int, error) {
+	exitCodeBytes, err := os.ReadFile(s.exitcodePath(key))
+	if err != nil {
+		return 0, err
+	}
+	exitCode, err := strconv.Atoi(string(exitCodeBytes))
+	if err != nil || exitCode < 0 || exitCode > 255 {
+		return 0, fmt.Errorf("%w %q for %s", ErrInvalidStatus, exitCodeBytes, key.Hash)
+	}
+	return exitCode, nil
+}
+
+func (s *FSStore) ReadFromCache(key CacheKey) (ExecResult, error) {
+	var stdout, stderr []byte
+	var exitCode int
+	var err error
+	stdout, err = readOutput(s.stdoutPath(key))
+	if err != nil {
+		return ExecResult{}, err
+	}
+	stderr, err = readOutput(s.stderrPath(key))
+	if err != nil {
+		return ExecResult{}, err
+	}
+	exitCode, err = s.ReadExitCode(key)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	var files []OutputFile
+	if encoded, err := readOutput(s.filesPath(key)); err == nil {
+		if files, err = decodeFiles(encoded); err != nil {
+			return ExecResult{}, err
+		}
+	} else if !os.IsNotExist(err) {
+		return ExecResult{}, err
+	}
+	return ExecResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		ExitCode: exitCode,
+		Files:    files,
+	}, nil
+}
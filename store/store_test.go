@@ -0,0 +1,155 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartialWriteIsAbsent(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	key := testKey("a")
+
+	// As if killed after writing output but before status
+	if err := os.MkdirAll(s.KeyDir(key), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.stdoutPath(key), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(key) {
+		t.Error("partial entry exists")
+	}
+
+	writeTestEntry(t, s, key)
+	if !s.Exists(key) {
+		t.Error("complete entry doesn't exist")
+	}
+}
+
+func TestRewriteReplacesWholeEntry(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	key := testKey("a")
+	if err := s.WriteToCache(key, ExecResult{Stdout: []byte("old"), Files: []OutputFile{{Path: "f", Mode: 0644, Data: []byte("x")}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.Compress = true
+	if err := s.WriteToCache(key, ExecResult{Stdout: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(s.KeyDir(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	expected := []string{"err" + GZIP_EXT, "out" + GZIP_EXT, "status"}
+	if len(names) != len(expected) {
+		t.Fatalf("entry holds %v, expected %v", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Fatalf("entry holds %v, expected %v", names, expected)
+		}
+	}
+	result, err := s.ReadFromCache(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "new" || result.Files != nil {
+		t.Errorf("read back %q with files %v", result.Stdout, result.Files)
+	}
+}
+
+func TestGCStaging(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	writeTestEntry(t, s, testKey("a"))
+
+	stale := filepath.Join(s.Dir, STAGING_PREFIX+"stale")
+	fresh := filepath.Join(s.Dir, STAGING_PREFIX+"fresh")
+	for _, dir := range []string{stale, fresh} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * STAGING_MAX_AGE)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.GCStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d, expected 1", removed)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale staging directory wasn't removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("fresh staging directory was removed")
+	}
+	if !s.Exists(testKey("a")) {
+		t.Error("entry was removed")
+	}
+}
+
+func TestKeyFromDistinguishesArgs(t *testing.T) {
+	cases := []struct {
+		command string
+		args    []string
+	}{
+		{"cmd", nil},
+		{"cmd", []string{""}},
+		{"cmd", []string{"", ""}},
+		{"cmd", []string{"a b"}},
+		{"cmd", []string{"a", "b"}},
+		{"cmd", []string{"ab"}},
+		{"cmd", []string{"a", ""}},
+		{"cmd", []string{"", "a"}},
+		{"cmd a", nil},
+		{"", []string{"cmd"}},
+	}
+	seen := make(map[string]int)
+	for i, c := range cases {
+		hash := KeyFrom(c.command, c.args).Hash
+		if j, ok := seen[hash]; ok {
+			t.Errorf("%q %q has the same key as %q %q", c.command, c.args, cases[j].command, cases[j].args)
+		}
+		seen[hash] = i
+	}
+
+	if KeyFrom("cmd", nil).Hash != KeyFrom("cmd", []string{}).Hash {
+		t.Error("nil and empty args have different keys")
+	}
+}
+
+func TestMetaNonUTF8Args(t *testing.T) {
+	s := &FSStore{Dir: t.TempDir()}
+	args := []string{"caf\xe9", "it's", "plain"}
+	key := KeyFrom("cat", args)
+	if err := s.WriteToCache(key, ExecResult{}); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := s.ReadMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Args) != len(args) {
+		t.Fatalf("args = %q, want %q", meta.Args, args)
+	}
+	for i, arg := range args {
+		if meta.Args[i] != arg {
+			t.Errorf("arg %d = %q, want %q", i, meta.Args[i], arg)
+		}
+	}
+	if line, expected := meta.CommandLine(), `cat $'caf\xe9' it's plain`; line != expected {
+		t.Errorf("command line = %q, want %q", line, expected)
+	}
+}
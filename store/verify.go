@@ -0,0 +1,63 @@
+package store
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/* Integrity checks */
+
+// Checks that the entry for key is intact: that its output can be read (and
+// decompressed), its status and metadata parse, and that output stored as a
+// blob still matches the hash the blob is named after. Returns the first
+// problem found.
+func (s *FSStore) Verify(key CacheKey) error {
+	for _, path := range []string{s.stdoutPath(key), s.stderrPath(key)} {
+		if _, err := readOutput(path); err != nil {
+			return fmt.Errorf("unreadable %s: %w", filepath.Base(path), err)
+		}
+		if err := s.verifyBlob(ResolveOutputPath(path)); err != nil {
+			return err
+		}
+	}
+	if _, err := s.ReadExitCode(key); err != nil {
+		return err
+	}
+	if encoded, err := readOutput(s.filesPath(key)); err == nil {
+		if _, err := decodeFiles(encoded); err != nil {
+			return err
+		}
+		if err := s.verifyBlob(ResolveOutputPath(s.filesPath(key))); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("unreadable files: %w", err)
+	}
+	if _, err := s.ReadMeta(key); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Checks that an output file linked to a blob has the content the blob is
+// named after. Plain copies, which aren't content-addressed, always pass.
+func (s *FSStore) verifyBlob(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if links, ok := linkCount(path, info); !ok || links < 2 {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	blob, err := os.Stat(filepath.Join(s.blobsDir(), fmt.Sprintf("%x", sha256.Sum256(data))))
+	if err != nil || !os.SameFile(info, blob) {
+		return fmt.Errorf("%s doesn't match its recorded content hash", filepath.Base(path))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Version of cachenv, recorded in the metadata of each cache entry. Replaced
+// at startup by the version of the build, if known.
+var Version = "0.1.0"
+
+// Compares two dotted version strings numerically (e.g. "0.10.0" > "0.9.1"),
+// returning -1, 0, or 1. A leading "v" is ignored, as is anything after a
+// component's leading digits (e.g. "0.1.0-3-gabc123" or "0.1.0+abc123" is
+// 0.1.0). Missing components count as zero, and the empty version sorts
+// before all others.
+func compareVersions(a, b string) int {
+	if a == "" || b == "" {
+		return strings.Compare(a, b)
+	}
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an = leadingNumber(as[i])
+		}
+		if i < len(bs) {
+			bn = leadingNumber(bs[i])
+		}
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Returns the number formed by the leading digits of s, or zero if none
+func leadingNumber(s string) int {
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(s)
+	}
+	n, _ := strconv.Atoi(s[:end])
+	return n
+}
@@ -0,0 +1,22 @@
+package store
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.10.0", "0.9.1", 1},
+		{"0.1.0", "v0.1.0", 0},
+		{"0.1", "0.1.0", 0},
+		{"0.1.0+abc123-dirty", "0.1.0", 0},
+		{"v0.1.0-3-gabc123", "0.1.1", -1},
+		{"", "0.1.0", -1},
+	}
+	for _, test := range tests {
+		if actual := compareVersions(test.a, test.b); actual != test.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", test.a, test.b, actual, test.expected)
+		}
+	}
+}
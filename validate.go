@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Config validation */
+
+// Matches a mapping key at the start of a YAML line, capturing its
+// indentation and name
+var yamlKeyPattern = regexp.MustCompile(`^( *)([^\s#:'"-][^:]*|'[^']*'|"[^"]*"):`)
+
+// Returns the line number of each command's entry under memoize_commands, for
+// pointing at problems. This is a plain scan of the file rather than a full
+// YAML parse, so flow-style mappings aren't recognized.
+func commandLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	inCommands, indent := false, -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		match := yamlKeyPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		name := strings.Trim(strings.TrimSpace(match[2]), `'"`)
+		switch {
+		case len(match[1]) == 0:
+			inCommands, indent = name == "memoize_commands", -1
+		case inCommands && (indent == -1 || len(match[1]) == indent):
+			indent = len(match[1])
+			lines[name] = n
+		}
+	}
+	return lines
+}
+
+// Returns an error if ignore_args or volatile_args would leave some of cmd's
+// default_args out of its cache key, which likely isn't what was meant
+func (c *Cachenv) checkDefaultArgs(cmd string) error {
+	cmdConfig := c.Config.Commands[cmd]
+	defaults := cmdConfig.DefaultArgs
+	if len(defaults) == 0 || cmdConfig.KeyArgs != nil {
+		return nil
+	}
+	keyed := stripVolatileArgs(stripArgs(defaults, cmdConfig.IgnoreArgs), cmdConfig.VolatileArgs)
+	if len(keyed) != len(defaults) {
+		return errors.New("default_args are partly left out of the cache key by ignore_args or volatile_args")
+	}
+	return nil
+}
+
+// Checks a config file (by default, the active cachenv's): that it parses,
+// has no unknown keys or invalid values, and that every memoized command can
+// be found. Exits 1 if there are any problems.
+func handleValidate(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv validate [CONFIG]")
+		return 1
+	}
+
+	var path string
+	if len(args) == 1 {
+		path = args[0]
+	} else {
+		dir, err := getActiveCachenvDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+			return 1
+		}
+		path = loadCachenvFromDir(dir).ConfigPath
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading config: %v\n", err)
+		return 1
+	}
+	config, err := decodeConfig(data)
+	if err != nil {
+		// The decoder's errors already carry line numbers
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	problems := config.Problems()
+	c := &Cachenv{Config: config.Resolved()}
+	commands := make([]string, 0, len(config.Commands))
+	for cmd := range config.Commands {
+		commands = append(commands, cmd)
+	}
+	sort.Strings(commands)
+	for _, cmd := range commands {
+		if _, err := c.RedactorFor(cmd); err != nil {
+			problems = append(problems, &store.CommandError{Command: cmd, Err: err})
+		}
+		if err := c.checkDefaultArgs(cmd); err != nil {
+			problems = append(problems, &store.CommandError{Command: cmd, Err: err})
+		}
+		// (A relative path is already a problem)
+		if realPath := config.Commands[cmd].Path; realPath != "" {
+			if err := checkExecutable(realPath); err != nil && filepath.IsAbs(realPath) {
+				problems = append(problems, &store.CommandError{Command: cmd, Err: err})
+			}
+		} else if _, ok := lookPathSkippingSelf(cmd); !ok {
+			problems = append(problems, &store.CommandError{Command: cmd, Err: errors.New("not found in PATH")})
+		}
+	}
+
+	lines := commandLines(data)
+	for _, problem := range problems {
+		var cmdErr *store.CommandError
+		if errors.As(problem, &cmdErr) && lines[cmdErr.Command] != 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, lines[cmdErr.Command], problem)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	infof("%s is valid.\n", path)
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/* Verification */
+
+// Checks every entry for corruption (e.g. from a partial write or a failing
+// disk), reporting the broken ones and with --prune removing them. Exits 1 if
+// any broken entries remain.
+func handleVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	prune := flags.Bool("prune", false, "remove broken entries")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv verify [--prune]")
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	keys, err := c.FS.Keys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing entries: %v\n", err)
+		return 1
+	}
+
+	broken, removed := 0, 0
+	for _, key := range keys {
+		problem := c.FS.Verify(key)
+		if problem == nil {
+			continue
+		}
+		broken++
+		fmt.Fprintf(os.Stderr, "Broken entry %s: %v\n", key.Hash, problem)
+		if *prune {
+			if err := c.FS.Remove(key); err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing entry: %v\n", err)
+				continue
+			}
+			removed++
+		}
+	}
+
+	switch {
+	case broken == 0:
+		infof("Verified %d entries; all ok.\n", len(keys))
+	case *prune:
+		infof("Verified %d entries; removed %d of %d broken.\n", len(keys), removed, broken)
+	default:
+		fmt.Fprintf(os.Stderr, "Verified %d entries; %d broken. Run 'cachenv verify --prune' to remove them.\n", len(keys), broken)
+	}
+	if broken > removed {
+		return 1
+	}
+	return 0
+}
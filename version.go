@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Version */
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=$(git describe --tags)"
+//
+// The resolved version replaces store.Version at startup, so it's also what
+// entries record and what 'cachenv prune --older-version' compares against.
+var version = ""
+
+// Returns the version of this build: the injected version if any, otherwise
+// the module version recorded by 'go install', otherwise store.Version with
+// the VCS revision it was built from
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return store.Version
+	}
+	// Untagged builds get a v0.0.0 pseudo-version, which would sort entries
+	// they write before those of any release
+	if v := info.Main.Version; v != "" && v != "(devel)" && !strings.HasPrefix(v, "v0.0.0-") {
+		return v
+	}
+	var revision string
+	var modified bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return store.Version
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return store.Version + "+" + revision
+}
+
+func handleVersion(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cachenv version")
+		return 1
+	}
+	fmt.Printf("cachenv %s\n", store.Version)
+	return 0
+}
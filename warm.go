@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+/* Warming */
+
+// Splits a line into words like a shell would, honoring single and double
+// quotes and backslash escapes (but nothing else, e.g. no variables)
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// Reads the commands to warm, one per line. Blank lines and lines starting
+// with '#' are skipped.
+func readWarmList(r io.Reader) ([][]string, error) {
+	var commands [][]string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words, err := splitWords(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		commands = append(commands, words)
+	}
+	return commands, scanner.Err()
+}
+
+// Runs each command listed in FILE (or stdin) through the cache, discarding
+// its output, so that later invocations hit. Commands already cached are
+// skipped unless --force. Exits 1 if any command couldn't be cached.
+func handleWarm(args []string) int {
+	usage := "Usage: cachenv warm [--parallel N] [--force] [FILE]"
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	parallel := flags.Int("parallel", 1, "number of commands to run at once")
+	force := flags.Bool("force", false, "rerun commands which are already cached, replacing their entries")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 || *parallel < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	c, err := loadActiveCachenv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading active cachenv: %v\n", err)
+		return 1
+	}
+
+	input := os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		if input, err = os.Open(flags.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening list: %v\n", err)
+			return 1
+		}
+		defer input.Close()
+	}
+	commands, err := readWarmList(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading list: %v\n", err)
+		return 1
+	}
+
+	// Each command runs in its own 'cachenv run', exactly as if it were
+	// invoked through its symlink, and without stdin
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding cachenv executable: %v\n", err)
+		return 1
+	}
+
+	var mu sync.Mutex
+	var skipped, failed int
+	warmed := map[string]bool{}
+	warm := func(words []string) {
+		cmdLine := strings.Join(words, " ")
+		fail := func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed++
+			fmt.Fprintf(os.Stderr, "Not cached: %s ("+format+")\n", append([]any{cmdLine}, args...)...)
+		}
+
+		cmdName := words[0]
+		if !c.IsCommandMemoized(cmdName) {
+			fail("not memoized")
+			return
+		}
+		key, err := c.KeyFor(cmdName, words[1:], nil)
+		if err != nil {
+			fail("%v", err)
+			return
+		}
+		if !*force && c.Fresh(key, c.Config.Commands[cmdName]) {
+			mu.Lock()
+			skipped++
+			mu.Unlock()
+			return
+		}
+
+		cmd := exec.Command(self, append([]string{"--dir", c.Dir, "--config", c.ConfigPath, "run"}, words...)...)
+		if *force {
+			cmd.Env = append(os.Environ(), "CACHENV_REFRESH=1")
+		}
+		err = cmd.Run()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			fail("%v", err)
+			return
+		}
+		if !c.Store.Exists(key) {
+			fail("exit status %d", cmd.ProcessState.ExitCode())
+			return
+		}
+		// Identical invocations (e.g. differing only in ignore_args) share
+		// an entry
+		mu.Lock()
+		warmed[key.Hash] = true
+		mu.Unlock()
+	}
+
+	queue := make(chan []string)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for words := range queue {
+				warm(words)
+			}
+		}()
+	}
+	for _, words := range commands {
+		queue <- words
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Fprintf(os.Stderr, "Warmed %d entries; %d already cached, %d not cached.\n", len(warmed), skipped, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
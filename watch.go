@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+/* Watched files */
+
+// Fingerprint of a watched file which doesn't exist
+const ABSENT_FILE = "absent"
+
+// Fingerprint of a watched path which is a directory rather than a file
+const DIRECTORY_FILE = "dir"
+
+// Returns a fingerprint ("path:<sha256>") of each file matched by the
+// command's watch_files patterns or, with watch_args, named by its arguments.
+// A pattern matching nothing (e.g. a missing file) contributes
+// "pattern:absent", so that creating the file changes the key.
+func watchedFiles(cmdConfig store.CommandConfig, args []string) ([]string, error) {
+	var fingerprints []string
+	for _, pattern := range cmdConfig.WatchFiles {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid watch_files pattern '%s': %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			fingerprints = append(fingerprints, pattern+":"+ABSENT_FILE)
+		}
+		for _, path := range matches {
+			fingerprint, err := fileFingerprint(path)
+			if err != nil {
+				return nil, err
+			}
+			fingerprints = append(fingerprints, path+":"+fingerprint)
+		}
+	}
+
+	if cmdConfig.WatchArgs {
+		for _, arg := range args {
+			if info, err := os.Stat(arg); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			fingerprint, err := fileFingerprint(arg)
+			if err != nil {
+				return nil, err
+			}
+			fingerprints = append(fingerprints, arg+":"+fingerprint)
+		}
+	}
+	return fingerprints, nil
+}
+
+// Returns the SHA-256 of the file at path, or a placeholder if it's missing or
+// a directory
+func fileFingerprint(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ABSENT_FILE, nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	if info.IsDir() {
+		return DIRECTORY_FILE, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aromatt/cachenv/store"
+)
+
+func TestWatchedFileEditMisses(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "data.txt")
+	for name, cmdConfig := range map[string]store.CommandConfig{
+		"watch_files": {WatchFiles: []string{data}},
+		"watch_args":  {WatchArgs: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newTestCachenv(t, map[string]store.CommandConfig{"cat": cmdConfig})
+			run := func() string {
+				return captureStdout(t, func() { c.HandleMemoizedCommand("cat", []string{data}) })
+			}
+			if err := os.WriteFile(data, []byte("one\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			run()
+			if out := run(); out != "one\n" {
+				t.Errorf("output = %q, want %q", out, "one\n")
+			}
+
+			if err := os.WriteFile(data, []byte("two\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if out := run(); out != "two\n" {
+				t.Errorf("after edit, output = %q, want %q", out, "two\n")
+			}
+			stats, err := c.FS.ReadStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Hits != 1 || stats.Misses != 2 {
+				t.Errorf("stats = %+v, want 1 hit and 2 misses", stats)
+			}
+		})
+	}
+}
+
+func TestWatchedFileAbsent(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	cmdConfig := store.CommandConfig{WatchFiles: []string{missing}}
+
+	absent, err := watchedFiles(cmdConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(absent) != 1 || absent[0] != missing+":"+ABSENT_FILE {
+		t.Errorf("fingerprints = %q, want %s absent", absent, missing)
+	}
+
+	if err := os.WriteFile(missing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	present, err := watchedFiles(cmdConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(present) != 1 || present[0] == absent[0] {
+		t.Errorf("creating the file didn't change its fingerprint: %q", present)
+	}
+}